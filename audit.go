@@ -0,0 +1,317 @@
+package ginoauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Decision is the outcome of an access check recorded in an AuditEvent.
+type Decision string
+
+const (
+	// DecisionGrant is recorded if the request was allowed to pass.
+	DecisionGrant Decision = "grant"
+	// DecisionDeny is recorded if the request was aborted.
+	DecisionDeny Decision = "deny"
+)
+
+// AuditEvent is the structured record of a single access decision
+// taken by the Auth middleware.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	UID      string    `json:"uid,omitempty"`
+	Realm    string    `json:"realm,omitempty"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	FlowID   string    `json:"flow_id,omitempty"`
+	Method   string    `json:"method"`
+	Route    string    `json:"route"`
+	Decision Decision  `json:"decision"`
+	Check    string    `json:"check,omitempty"`  // name of the granting or last denying AccessCheckFunction
+	Reason   string    `json:"reason,omitempty"` // why access was denied
+}
+
+// AuditSink receives an AuditEvent for every access decision.
+// Implementations must be safe for concurrent use.
+type AuditSink interface {
+	Audit(e AuditEvent) error
+}
+
+// DefaultAuditSink is used by the Auth middleware if Options.AuditSink
+// is not set. It is nil by default, which disables auditing.
+//
+// Example:
+//
+//	sink, err := ginoauth2.NewFileAuditSink("/var/log/app/audit.jsonl", 100<<20, 5)
+//	if err != nil {
+//		glog.Fatalf("failed to open audit log: %v", err)
+//	}
+//	ginoauth2.DefaultAuditSink = ginoauth2.NewAsyncAuditSink(sink, 1024)
+var DefaultAuditSink AuditSink
+
+func (o Options) auditSink() AuditSink {
+	if o.AuditSink != nil {
+		return o.AuditSink
+	}
+	return DefaultAuditSink
+}
+
+// funcName returns the name of the function backing a check, p.e.
+// "github.com/zalando/gin-oauth2/zalando.UidCheck.func1".
+func funcName(fn interface{}) string {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return ""
+	}
+	if f := runtime.FuncForPC(v.Pointer()); f != nil {
+		return f.Name()
+	}
+	return ""
+}
+
+func audit(o Options, r *http.Request, route, clientIP string, res authResult) {
+	if route == "" {
+		route = r.URL.Path
+	}
+	writeAudit(o, AuditEvent{
+		ClientIP: clientIP,
+		FlowID:   FlowIDFromContext(r.Context()),
+		Method:   r.Method,
+		Route:    route,
+		Check:    res.check,
+	}, res)
+}
+
+// Audit records the decision of Verify in the AuditSink of o. It is
+// the audit counterpart of Verify for integrations with other
+// frameworks, p.e. grpcauth, which set method and route to the RPC.
+// err is nil if access was granted.
+func Audit(ctx context.Context, o Options, method, route, clientIP string, tc *TokenContainer, err error) {
+	writeAudit(o, AuditEvent{
+		ClientIP: clientIP,
+		FlowID:   FlowIDFromContext(ctx),
+		Method:   method,
+		Route:    route,
+	}, authResult{tc: tc, err: err})
+}
+
+// writeAudit completes e with the outcome res and writes it to the
+// AuditSink of o.
+func writeAudit(o Options, e AuditEvent, res authResult) {
+	sink := o.auditSink()
+	if sink == nil {
+		return
+	}
+
+	e.Time = time.Now().UTC()
+	e.Decision = DecisionDeny
+	if res.tc != nil {
+		e.Realm = res.tc.Realm
+		e.UID = res.uid()
+	}
+	if res.err != nil {
+		e.Reason = maskAccessToken(res.err)
+	} else {
+		e.Decision = DecisionGrant
+	}
+
+	if err := sink.Audit(e); err != nil {
+		errorw("Failed to write audit event", "error", err)
+	}
+}
+
+// FileAuditSink writes AuditEvents as JSON lines to a file. The file
+// is rotated once it grows beyond MaxSize bytes, keeping up to
+// MaxBackups old files named <path>.1 (newest) to <path>.<MaxBackups>.
+type FileAuditSink struct {
+	Path       string
+	MaxSize    int64 // 0 disables rotation
+	MaxBackups int
+
+	mu          sync.Mutex
+	f           *os.File
+	size        int64
+	retryRotate time.Time
+}
+
+// NewFileAuditSink opens or creates the audit file at path in append
+// mode.
+func NewFileAuditSink(path string, maxSize int64, maxBackups int) (*FileAuditSink, error) {
+	s := &FileAuditSink{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileAuditSink) open() error {
+	f, size, err := openAuditFile(s.Path, 0)
+	if err != nil {
+		return err
+	}
+	s.f, s.size = f, size
+	return nil
+}
+
+func openAuditFile(path string, flag int) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|flag, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// auditRotateRetry is the time to wait before a failed rotation is
+// retried. Events are written to the current file meanwhile.
+const auditRotateRetry = time.Minute
+
+// rotate moves the current file away and opens a new one. The current
+// file stays open until the new one is opened, such that a failed
+// rotation never stops the audit log.
+func (s *FileAuditSink) rotate() error {
+	var (
+		f    *os.File
+		size int64
+		err  error
+	)
+	if s.MaxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", s.Path, s.MaxBackups))
+		for i := s.MaxBackups - 1; i > 0; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", s.Path, i), fmt.Sprintf("%s.%d", s.Path, i+1))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(s.Path, s.Path+".1"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		f, size, err = openAuditFile(s.Path, 0)
+	} else {
+		f, size, err = openAuditFile(s.Path, os.O_TRUNC)
+	}
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f, s.size = f, size
+	return nil
+}
+
+// Audit implements AuditSink.
+func (s *FileAuditSink) Audit(e AuditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.New("audit sink is closed")
+	}
+	if s.MaxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.MaxSize && !time.Now().Before(s.retryRotate) {
+		if err := s.rotate(); err != nil {
+			errorw("Failed to rotate audit file, retrying later", "path", s.Path, "error", err)
+			s.retryRotate = time.Now().Add(auditRotateRetry)
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Close closes the underlying file.
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// AsyncAuditSink decouples request processing from a slow AuditSink.
+// Events are queued in a bounded buffer and written by a background
+// goroutine. If the buffer is full, events are dropped instead of
+// blocking the request.
+type AsyncAuditSink struct {
+	sink    AuditSink
+	events  chan AuditEvent
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewAsyncAuditSink starts a background writer for sink with a buffer
+// of size events.
+func NewAsyncAuditSink(sink AuditSink, size int) *AsyncAuditSink {
+	a := &AsyncAuditSink{
+		sink:   sink,
+		events: make(chan AuditEvent, size),
+		done:   make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AsyncAuditSink) run() {
+	defer close(a.done)
+	for e := range a.events {
+		if err := a.sink.Audit(e); err != nil {
+			errorw("Failed to write audit event", "error", err)
+		}
+	}
+}
+
+// Audit implements AuditSink. It never blocks.
+func (a *AsyncAuditSink) Audit(e AuditEvent) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		a.dropped.Add(1)
+		return nil
+	}
+	select {
+	case a.events <- e:
+	default:
+		a.dropped.Add(1)
+	}
+	return nil
+}
+
+// Dropped returns the number of events that were discarded because
+// the buffer was full or the sink was closed.
+func (a *AsyncAuditSink) Dropped() uint64 {
+	return a.dropped.Load()
+}
+
+// Close flushes all buffered events to the wrapped sink and stops the
+// background writer. It does not close the wrapped sink.
+func (a *AsyncAuditSink) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.events)
+	}
+	a.mu.Unlock()
+	<-a.done
+	return nil
+}
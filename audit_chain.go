@@ -0,0 +1,281 @@
+package ginoauth2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// genesisHash is the prev value of the first record in a chain.
+var genesisHash = hex.EncodeToString(make([]byte, sha256.Size))
+
+// chainedRecord is a single line written by HashChainAuditSink. Hash
+// covers Seq, Prev and the raw Event bytes, such that editing,
+// removing or reordering records breaks the chain.
+type chainedRecord struct {
+	Seq   uint64          `json:"seq"`
+	Prev  string          `json:"prev"`
+	Event json.RawMessage `json:"event"`
+	Hash  string          `json:"hash"`
+	MAC   string          `json:"mac,omitempty"`
+}
+
+func chainHash(seq uint64, prev string, event []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(strconv.FormatUint(seq, 10)))
+	h.Write([]byte{'\n'})
+	h.Write(event)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func chainMAC(key []byte, hash string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(hash))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// HashChainAuditSink is a tamper-evident AuditSink. It writes JSON
+// lines where every record carries the hash of its predecessor and,
+// if a key is configured, an HMAC-SHA256 of its own hash. Use
+// VerifyAuditChain to check a written file.
+type HashChainAuditSink struct {
+	mu   sync.Mutex
+	f    *os.File
+	key  []byte
+	seq  uint64
+	prev string
+}
+
+// ErrEmptyAuditKey is returned if an HMAC key is given but empty, p.e.
+// read from an empty key file.
+var ErrEmptyAuditKey = errors.New("empty audit HMAC key")
+
+// maxAuditRecordSize is the maximum length of a line in the audit log.
+const maxAuditRecordSize = 1024 * 1024
+
+// auditKey returns key without leading and trailing whitespace, such
+// that a key file ending in a newline can be used as read. The sink
+// and the verifier use the same key this way.
+func auditKey(key []byte) ([]byte, error) {
+	if key == nil {
+		return nil, nil
+	}
+	if key = bytes.TrimSpace(key); len(key) == 0 {
+		return nil, ErrEmptyAuditKey
+	}
+	return key, nil
+}
+
+// checkRecord returns why the hash or MAC of rec is invalid or "".
+func checkRecord(rec chainedRecord, key []byte) string {
+	switch {
+	case chainHash(rec.Seq, rec.Prev, rec.Event) != rec.Hash:
+		return "hash does not match record content"
+	case key != nil && !hmac.Equal([]byte(chainMAC(key, rec.Hash)), []byte(rec.MAC)):
+		return "invalid mac"
+	}
+	return ""
+}
+
+// NewHashChainAuditSink opens or creates the audit file at path. If
+// the file already contains records, the chain is continued from the
+// last record, which has to be valid. A partially written last record,
+// p.e. after a crash, is removed. key may be nil to disable HMACs, but
+// not empty; leading and trailing whitespace of key is ignored.
+func NewHashChainAuditSink(path string, key []byte) (*HashChainAuditSink, error) {
+	key, err := auditKey(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s := &HashChainAuditSink{f: f, key: key, prev: genesisHash}
+	if err := s.resume(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to continue audit log %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// resume continues the chain from the last record of the file. Only
+// the tail of the file is read.
+func (s *HashChainAuditSink) resume() error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	buf := make([]byte, min(size, 2*maxAuditRecordSize))
+	start := size - int64(len(buf))
+	if _, err := s.f.ReadAt(buf, start); err != nil {
+		return err
+	}
+
+	i := bytes.LastIndexByte(buf, '\n')
+	if i < 0 && start > 0 {
+		return errors.New("last audit record too long")
+	}
+	complete, partial := buf[:i+1], buf[i+1:]
+
+	if lines := bytes.TrimRight(complete, "\n"); len(lines) > 0 {
+		j := bytes.LastIndexByte(lines, '\n')
+		if j < 0 && start > 0 {
+			return errors.New("last audit record too long")
+		}
+		var rec chainedRecord
+		if err := json.Unmarshal(lines[j+1:], &rec); err != nil {
+			return fmt.Errorf("malformed last audit record: %w", err)
+		}
+		if reason := checkRecord(rec, s.key); reason != "" {
+			return fmt.Errorf("invalid last audit record: %s", reason)
+		}
+		s.seq = rec.Seq
+		s.prev = rec.Hash
+	}
+	if len(partial) == 0 {
+		return nil
+	}
+
+	// a record continuing the chain only misses its newline
+	var rec chainedRecord
+	if json.Unmarshal(partial, &rec) == nil && checkRecord(rec, s.key) == "" && rec.Seq == s.seq+1 && rec.Prev == s.prev {
+		if _, err := s.f.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+		s.seq = rec.Seq
+		s.prev = rec.Hash
+		return nil
+	}
+	errorw("Remove partially written audit record", "size", len(partial))
+	return s.f.Truncate(size - int64(len(partial)))
+}
+
+// Audit implements AuditSink.
+func (s *HashChainAuditSink) Audit(e AuditEvent) error {
+	event, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.New("audit sink is closed")
+	}
+
+	rec := chainedRecord{Seq: s.seq + 1, Prev: s.prev, Event: event}
+	rec.Hash = chainHash(rec.Seq, rec.Prev, rec.Event)
+	if s.key != nil {
+		rec.MAC = chainMAC(s.key, rec.Hash)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.seq = rec.Seq
+	s.prev = rec.Hash
+	return nil
+}
+
+// Last returns the sequence number and hash of the last record. Store
+// them outside of the audit log, p.e. periodically in another system,
+// to detect truncation with VerifyAuditChainAnchor.
+func (s *HashChainAuditSink) Last() (uint64, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq, s.prev
+}
+
+// Close closes the underlying file.
+func (s *HashChainAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// ChainError reports the first broken link found by VerifyAuditChain.
+type ChainError struct {
+	Line   int // 1-based line number of the offending record
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+}
+
+// VerifyAuditChain reads records written by HashChainAuditSink from r
+// and checks every link of the chain. If key is not nil, the HMAC of
+// every record is verified as well, ignoring leading and trailing
+// whitespace of key like NewHashChainAuditSink. It returns the number of valid
+// records and a *ChainError for the first broken link.
+//
+// Records removed from the end of the log can not be detected by the
+// chain itself, use VerifyAuditChainAnchor for that.
+func VerifyAuditChain(r io.Reader, key []byte) (int, error) {
+	return VerifyAuditChainAnchor(r, key, "")
+}
+
+// VerifyAuditChainAnchor is like VerifyAuditChain, but additionally
+// requires a record with the hash anchor, p.e. a hash returned by
+// HashChainAuditSink.Last and stored elsewhere. A log truncated before
+// that record is reported as broken. An empty anchor is not checked.
+func VerifyAuditChainAnchor(r io.Reader, key []byte, anchor string) (int, error) {
+	key, err := auditKey(key)
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxAuditRecordSize)
+
+	prev := genesisHash
+	var seq uint64
+	line := 0
+	anchored := anchor == ""
+	for scanner.Scan() {
+		line++
+		var rec chainedRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return line - 1, &ChainError{Line: line, Reason: "malformed record: " + err.Error()}
+		}
+		switch {
+		case rec.Seq != seq+1:
+			return line - 1, &ChainError{Line: line, Reason: fmt.Sprintf("sequence %d follows %d", rec.Seq, seq)}
+		case rec.Prev != prev:
+			return line - 1, &ChainError{Line: line, Reason: "prev does not match hash of previous record"}
+		}
+		if reason := checkRecord(rec, key); reason != "" {
+			return line - 1, &ChainError{Line: line, Reason: reason}
+		}
+		seq = rec.Seq
+		prev = rec.Hash
+		anchored = anchored || rec.Hash == anchor
+	}
+	if err := scanner.Err(); err != nil {
+		return line, err
+	}
+	if !anchored {
+		return line, &ChainError{Line: line + 1, Reason: "anchor record missing, log truncated"}
+	}
+	return line, nil
+}
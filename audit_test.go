@@ -0,0 +1,272 @@
+package ginoauth2
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+type memoryAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (m *memoryAuditSink) Audit(e AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, e)
+	return nil
+}
+
+func (m *memoryAuditSink) last() AuditEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.events[len(m.events)-1]
+}
+
+func TestAuditEvents(t *testing.T) {
+	srv := newTokenInfoServer(t, nil)
+	sink := &memoryAuditSink{}
+	o := Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}, AuditSink: sink}
+
+	doRequest(newTestRouter(o, denyAll, allowAll), bearer("token"))
+	e := sink.last()
+	assert.Equal(t, DecisionGrant, e.Decision)
+	assert.Equal(t, "sszuecs", e.UID)
+	assert.Equal(t, "/employees", e.Realm)
+	assert.Equal(t, http.MethodGet, e.Method)
+	assert.Equal(t, "/private/:id", e.Route)
+	assert.True(t, strings.HasSuffix(e.Check, ".allowAll"), e.Check)
+	assert.Empty(t, e.Reason)
+
+	doRequest(newTestRouter(o, denyAll), bearer("token"))
+	e = sink.last()
+	assert.Equal(t, DecisionDeny, e.Decision)
+	assert.Equal(t, "sszuecs", e.UID)
+	assert.True(t, strings.HasSuffix(e.Check, ".denyAll"), e.Check)
+	assert.Equal(t, "access to the Resource is forbidden", e.Reason)
+
+	doRequest(newTestRouter(o, allowAll), nil)
+	e = sink.last()
+	assert.Equal(t, DecisionDeny, e.Decision)
+	assert.Empty(t, e.UID)
+	assert.Equal(t, "no authorization header", e.Reason)
+}
+
+func TestFileAuditSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileAuditSink(path, 200, 2)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sink.Audit(AuditEvent{Time: time.Now(), Method: "GET", Route: "/", Decision: DecisionGrant}))
+	}
+	require.NoError(t, sink.Close())
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(p)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, fi.Size(), int64(200))
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		assert.Equal(t, DecisionGrant, e.Decision)
+	}
+}
+
+func TestFileAuditSinkRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileAuditSink(path, 200, 1)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	// a non-empty directory can not be replaced by the rotated file
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o700))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, sink.Audit(AuditEvent{Time: time.Now(), Method: "GET", Route: "/", Decision: DecisionGrant}))
+	}
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Greater(t, fi.Size(), int64(200), "events are written to the current file")
+
+	require.NoError(t, os.RemoveAll(path+".1"))
+	sink.mu.Lock()
+	sink.retryRotate = time.Time{}
+	sink.mu.Unlock()
+	require.NoError(t, sink.Audit(AuditEvent{Time: time.Now(), Method: "GET", Route: "/", Decision: DecisionGrant}))
+	fi, err = os.Stat(path + ".1")
+	require.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	fi, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, fi.Size(), int64(200))
+}
+
+type blockingAuditSink struct {
+	release chan struct{}
+	memoryAuditSink
+}
+
+func (b *blockingAuditSink) Audit(e AuditEvent) error {
+	<-b.release
+	return b.memoryAuditSink.Audit(e)
+}
+
+func TestAsyncAuditSinkNeverBlocks(t *testing.T) {
+	inner := &blockingAuditSink{release: make(chan struct{})}
+	sink := NewAsyncAuditSink(inner, 2)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			sink.Audit(AuditEvent{Decision: DecisionGrant})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Audit blocked on a slow sink")
+	}
+
+	close(inner.release)
+	require.NoError(t, sink.Close())
+	assert.Equal(t, uint64(10), sink.Dropped()+uint64(len(inner.events)))
+	assert.NotZero(t, sink.Dropped())
+}
+
+func TestHashChainAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	key := []byte("secret")
+
+	sink, err := NewHashChainAuditSink(path, key)
+	require.NoError(t, err)
+	require.NoError(t, sink.Audit(AuditEvent{UID: "sszuecs", Decision: DecisionGrant}))
+	require.NoError(t, sink.Audit(AuditEvent{UID: "njuettner", Decision: DecisionDeny}))
+	require.NoError(t, sink.Close())
+
+	// reopening continues the chain
+	sink, err = NewHashChainAuditSink(path, key)
+	require.NoError(t, err)
+	require.NoError(t, sink.Audit(AuditEvent{UID: "sszuecs", Decision: DecisionGrant}))
+	seq, anchor := sink.Last()
+	assert.Equal(t, uint64(3), seq)
+	require.NoError(t, sink.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	n, err := VerifyAuditChain(strings.NewReader(string(data)), key)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, tt := range []struct {
+		name  string
+		input string
+		key   []byte
+		line  int
+	}{
+		{"edited record", strings.Replace(string(data), "njuettner", "mallory", 1), key, 2},
+		{"removed record", lines[0] + "\n" + lines[2] + "\n", key, 2},
+		{"swapped records", lines[1] + "\n" + lines[0] + "\n", key, 1},
+		{"wrong key", string(data), []byte("other"), 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := VerifyAuditChain(strings.NewReader(tt.input), tt.key)
+			var chainErr *ChainError
+			require.ErrorAs(t, err, &chainErr)
+			assert.Equal(t, tt.line, chainErr.Line)
+		})
+	}
+
+	// truncation is only detected with an anchor
+	truncated := lines[0] + "\n" + lines[1] + "\n"
+	_, err = VerifyAuditChain(strings.NewReader(truncated), key)
+	assert.NoError(t, err)
+	_, err = VerifyAuditChainAnchor(strings.NewReader(string(data)), key, anchor)
+	assert.NoError(t, err)
+	_, err = VerifyAuditChainAnchor(strings.NewReader(truncated), key, anchor)
+	var chainErr *ChainError
+	require.ErrorAs(t, err, &chainErr)
+	assert.Equal(t, 3, chainErr.Line)
+
+	_, err = VerifyAuditChain(strings.NewReader(string(data)), []byte{})
+	assert.ErrorIs(t, err, ErrEmptyAuditKey)
+	_, err = NewHashChainAuditSink(path, []byte{})
+	assert.ErrorIs(t, err, ErrEmptyAuditKey)
+}
+
+func TestHashChainAuditSinkResume(t *testing.T) {
+	key := []byte("secret\n")
+	write := func(t *testing.T, path string, uids ...string) {
+		sink, err := NewHashChainAuditSink(path, key)
+		require.NoError(t, err)
+		for _, uid := range uids {
+			require.NoError(t, sink.Audit(AuditEvent{UID: uid, Decision: DecisionGrant}))
+		}
+		require.NoError(t, sink.Close())
+	}
+	verify := func(t *testing.T, path string) int {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		n, err := VerifyAuditChain(strings.NewReader(string(data)), []byte("secret"))
+		require.NoError(t, err)
+		return n
+	}
+
+	t.Run("partial last record is removed", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		write(t, path, "sszuecs", "njuettner")
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+		require.NoError(t, err)
+		_, err = f.WriteString(`{"seq":3,"prev":"`)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		write(t, path, "sszuecs")
+		assert.Equal(t, 3, verify(t, path))
+	})
+
+	t.Run("record without newline is kept", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		write(t, path, "sszuecs", "njuettner")
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, data[:len(data)-1], 0o600))
+
+		write(t, path, "sszuecs")
+		assert.Equal(t, 3, verify(t, path))
+	})
+
+	t.Run("tampered last record", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		write(t, path, "sszuecs", "njuettner")
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(data), "njuettner", "mallory", 1)), 0o600))
+
+		_, err = NewHashChainAuditSink(path, key)
+		assert.ErrorContains(t, err, "hash does not match record content")
+		_, err = NewHashChainAuditSink(path, []byte("other"))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,107 @@
+package ginoauth2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ClaimsValidator is implemented by claims structs which validate
+// themselves after decoding, see DecodeClaims.
+type ClaimsValidator interface {
+	Validate() error
+}
+
+// DecodeClaims decodes the claims of tc into v, a pointer to a struct
+// with json tags. The claims are Scopes overlaying RawClaims, such
+// that a claim decodes to the same value as TokenContainer.Claim. If v
+// implements ClaimsValidator, it is validated after decoding.
+//
+// Example:
+//
+//	type Principal struct {
+//		UID   string   `json:"uid"`
+//		Teams []string `json:"teams"`
+//	}
+//	var p Principal
+//	err := ginoauth2.DecodeClaims(tc, &p)
+func DecodeClaims(tc *TokenContainer, v interface{}) error {
+	if tc == nil {
+		return ErrNoToken
+	}
+	claims := make(map[string]interface{}, len(tc.Scopes)+len(tc.RawClaims))
+	for k, c := range tc.RawClaims {
+		claims[k] = c
+	}
+	for k, c := range tc.Scopes {
+		claims[k] = c
+	}
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return fmt.Errorf("decode claims: %w", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("decode claims: %w", err)
+	}
+	if cv, ok := v.(ClaimsValidator); ok {
+		if err := cv.Validate(); err != nil {
+			return fmt.Errorf("invalid claims: %w", err)
+		}
+	}
+	return nil
+}
+
+type claimsCacheKey struct{}
+
+// claimsCache holds the claims decoded by Claims for one request.
+type claimsCache struct {
+	mu      sync.Mutex
+	decoded map[reflect.Type]claimsResult
+}
+
+type claimsResult struct {
+	v   interface{}
+	err error
+}
+
+// Claims returns the claims of the TokenContainer in ctx decoded into
+// T with DecodeClaims. The result is cached on the request context, so
+// the claims are decoded and validated once per request and type. ctx
+// may be the *gin.Context or the context of the *http.Request.
+//
+// Example:
+//
+//	p, err := ginoauth2.Claims[Principal](ctx)
+func Claims[T any](ctx context.Context) (T, error) {
+	var zero T
+	tc, ok := TokenContainerFromContext(ctx)
+	if !ok {
+		return zero, ErrNoToken
+	}
+	cache, _ := requestContext(ctx).Value(claimsCacheKey{}).(*claimsCache)
+	if cache == nil {
+		return decodeClaims[T](tc)
+	}
+
+	typ := reflect.TypeFor[T]()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if r, ok := cache.decoded[typ]; ok {
+		v, _ := r.v.(T)
+		return v, r.err
+	}
+	v, err := decodeClaims[T](tc)
+	cache.decoded[typ] = claimsResult{v: v, err: err}
+	return v, err
+}
+
+func decodeClaims[T any](tc *TokenContainer) (T, error) {
+	var v T
+	if err := DecodeClaims(tc, &v); err != nil {
+		var zero T
+		return zero, err
+	}
+	return v, nil
+}
@@ -0,0 +1,81 @@
+package ginoauth2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+type testPrincipal struct {
+	UID   string   `json:"uid"`
+	Realm string   `json:"realm"`
+	Teams []string `json:"teams"`
+	Level int      `json:"level"`
+}
+
+var validations int
+
+func (p testPrincipal) Validate() error {
+	validations++
+	if p.UID == "" {
+		return errors.New("missing uid")
+	}
+	return nil
+}
+
+func TestDecodeClaims(t *testing.T) {
+	tc := &TokenContainer{
+		Scopes:    map[string]interface{}{"uid": "sszuecs"},
+		RawClaims: map[string]interface{}{"realm": "/employees", "teams": []interface{}{"teapot"}, "level": float64(3)},
+	}
+	var p testPrincipal
+	assert.NoError(t, DecodeClaims(tc, &p))
+	assert.Equal(t, testPrincipal{UID: "sszuecs", Realm: "/employees", Teams: []string{"teapot"}, Level: 3}, p)
+
+	err := DecodeClaims(&TokenContainer{RawClaims: map[string]interface{}{"level": "high"}}, &p)
+	assert.ErrorContains(t, err, "decode claims")
+	err = DecodeClaims(&TokenContainer{}, &testPrincipal{})
+	assert.ErrorContains(t, err, "invalid claims: missing uid")
+	assert.ErrorIs(t, DecodeClaims(nil, &p), ErrNoToken)
+
+	// mapped claims win over raw claims of the same name, like in Claim
+	tc = &TokenContainer{
+		Scopes:    map[string]interface{}{"uid": "sszuecs"},
+		RawClaims: map[string]interface{}{"uid": "8e2a0f", "realm": "/employees"},
+	}
+	p = testPrincipal{}
+	assert.NoError(t, DecodeClaims(tc, &p))
+	assert.Equal(t, tc.UID(), p.UID)
+	assert.Equal(t, "/employees", p.Realm)
+}
+
+func TestClaimsCachedPerRequest(t *testing.T) {
+	srv := newTokenInfoServer(t, map[string]interface{}{"teams": []interface{}{"teapot"}})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(AuthChainOptions(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, allowAll))
+	var got []testPrincipal
+	router.GET("/private/:id", func(c *gin.Context) {
+		for i := 0; i < 3; i++ {
+			p, err := Claims[testPrincipal](c)
+			assert.NoError(t, err)
+			got = append(got, p)
+		}
+		c.Status(http.StatusOK)
+	})
+
+	validations = 0
+	assert.Equal(t, http.StatusOK, doRequest(router, bearer("token")).Code)
+	assert.Equal(t, http.StatusOK, doRequest(router, bearer("token")).Code)
+	assert.Equal(t, 2, validations)
+	assert.Len(t, got, 6)
+	assert.Equal(t, testPrincipal{UID: "sszuecs", Realm: "/employees", Teams: []string{"teapot"}}, got[5])
+
+	_, err := Claims[testPrincipal](context.Background())
+	assert.ErrorIs(t, err, ErrNoToken)
+}
@@ -0,0 +1,323 @@
+package ginoauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+// CheckFunction is the framework neutral variant of
+// AccessCheckFunction. It grants access by returning nil. Returning
+// an *AuthError controls the response, any other error results in
+// 403 Forbidden. Use AccessCheck to use a CheckFunction with the gin
+// middleware.
+type CheckFunction func(ctx context.Context, tc *TokenContainer) error
+
+// All returns a CheckFunction that grants access if all checks grant
+// access. Use it to combine requirements, as the middleware grants
+// access if any of its checks does.
+//
+// Example:
+//
+//	payouts.Use(ginoauth2.AuthChainOptions(o, ginoauth2.AccessCheck(ginoauth2.All(
+//		ginoauth2.RequireScopes("payout.write"),
+//		ginoauth2.RequireAMR("mfa"),
+//		ginoauth2.MaxAuthAge(5*time.Minute),
+//	))))
+func All(checks ...CheckFunction) CheckFunction {
+	return func(ctx context.Context, tc *TokenContainer) error {
+		for _, c := range checks {
+			if err := c(ctx, tc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+var (
+	// ErrNoToken is returned if the request carries no usable token.
+	ErrNoToken = errors.New("no token in context")
+	// ErrInvalidToken is returned if the token is expired or was
+	// rejected by the tokeninfo service.
+	ErrInvalidToken = errors.New("invalid Token")
+	// ErrForbidden is returned if no access check granted access.
+	ErrForbidden = errors.New("access to the Resource is forbidden")
+	// ErrUnavailable is returned if the token could not be validated,
+	// because the tokeninfo service could not be reached.
+	ErrUnavailable = errors.New("token validation unavailable")
+	// ErrTimeout is returned if validation and checks took longer
+	// than VarianceTimer.
+	ErrTimeout = errors.New("authorization check overtime")
+)
+
+// AuthError describes why a request was rejected. It wraps one of
+// the Err* values of this package, such that callers can use
+// errors.Is to classify it.
+type AuthError struct {
+	Status      int               // HTTP status code of the response
+	Code        string            // error code of the WWW-Authenticate challenge, p.e. "invalid_token"
+	Description string            // human readable reason, sent as error_description
+	Params      map[string]string // additional challenge parameters
+	Err         error             // classification, p.e. ErrForbidden
+	Cause       error             // underlying error, if any
+}
+
+func (e *AuthError) Error() string {
+	if e.Cause != nil {
+		return e.Cause.Error()
+	}
+	if e.Description != "" {
+		return e.Description
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the classification and the cause of the error.
+func (e *AuthError) Unwrap() []error {
+	if e.Cause != nil {
+		return []error{e.Err, e.Cause}
+	}
+	return []error{e.Err}
+}
+
+// Challenge returns the value of the WWW-Authenticate header for the
+// given authentication scheme or "" if e has no error code.
+func (e *AuthError) Challenge(scheme string) string {
+	if e.Code == "" {
+		return ""
+	}
+	params := []string{fmt.Sprintf("error=%q", e.Code)}
+	if e.Description != "" {
+		params = append(params, fmt.Sprintf("error_description=%q", e.Description))
+	}
+	keys := make([]string, 0, len(e.Params))
+	for k := range e.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		params = append(params, fmt.Sprintf("%s=%q", k, e.Params[k]))
+	}
+	return scheme + " " + strings.Join(params, ", ")
+}
+
+func newAuthError(status int, class error, cause error) *AuthError {
+	return &AuthError{Status: status, Err: class, Cause: cause}
+}
+
+func isAuthError(err error) bool {
+	var ae *AuthError
+	return errors.As(err, &ae)
+}
+
+// asAuthError converts err into an *AuthError, such that every
+// rejected request has a status. Errors without classification
+// result in 403 Forbidden.
+func asAuthError(err error) *AuthError {
+	var ae *AuthError
+	if errors.As(err, &ae) {
+		return ae
+	}
+	return newAuthError(http.StatusForbidden, ErrForbidden, err)
+}
+
+type namedCheck struct {
+	name string
+	fn   CheckFunction
+}
+
+// verify validates token and runs the checks until the first one
+// grants access.
+func verify(ctx context.Context, o Options, token *oauth2.Token, checks []namedCheck) authResult {
+	if !token.Valid() {
+		infow("Invalid Token - nil or expired", "flow_id", FlowIDFromContext(ctx))
+		return authResult{err: newAuthError(http.StatusUnauthorized, ErrInvalidToken, errors.New("invalid token - nil or expired"))}
+	}
+
+	if o.DenyList != nil {
+		if err := o.DenyList.checkToken(token.AccessToken); err != nil {
+			infow("Token revoked", "flow_id", FlowIDFromContext(ctx), "reason", err)
+			return authResult{err: err}
+		}
+	}
+
+	tc, err := o.validateToken(ctx, token)
+	if err != nil {
+		errorw("Can not extract TokenContainer", "flow_id", FlowIDFromContext(ctx), "error", err)
+		return authResult{err: asAuthError(err)}
+	}
+	if o.DenyList != nil {
+		if err := o.DenyList.checkContainer(tc); err != nil {
+			infow("Token revoked", "flow_id", FlowIDFromContext(ctx), "uid", tc.UID(), "reason", err)
+			return authResult{tc: tc, err: err}
+		}
+	}
+	if len(o.Audiences) > 0 && !tc.HasAudience(o.Audiences...) {
+		infow("Token audience not accepted", "flow_id", FlowIDFromContext(ctx), "uid", tc.UID(), "audience", tc.Audience)
+		ae := newAuthError(http.StatusUnauthorized, ErrInvalidToken, fmt.Errorf("token audience %v not accepted", tc.Audience))
+		ae.Code = "invalid_token"
+		ae.Description = "token audience not accepted"
+		return authResult{tc: tc, err: ae}
+	}
+	if !tc.Valid() {
+		return authResult{tc: tc, err: newAuthError(http.StatusUnauthorized, ErrInvalidToken, errors.New("invalid token - expired"))}
+	}
+	if err := o.checkCertificateBinding(ctx, tc); err != nil {
+		infow("Token binding not verified", "flow_id", FlowIDFromContext(ctx), "uid", tc.UID(), "reason", err)
+		return authResult{tc: tc, err: err}
+	}
+	if err := o.checkDPoPBinding(ctx, tc); err != nil {
+		infow("Token binding not verified", "flow_id", FlowIDFromContext(ctx), "uid", tc.UID(), "reason", err)
+		return authResult{tc: tc, err: err}
+	}
+
+	res := authResult{tc: tc}
+	var denied error
+	for _, c := range checks {
+		res.check = c.name
+		err := c.fn(ctx, tc)
+		if err == nil {
+			return res
+		}
+		// report the most specific reason of all failed checks
+		if denied == nil || (isAuthError(err) && !isAuthError(denied)) {
+			denied = err
+		}
+	}
+	res.err = asAuthError(denied)
+	return res
+}
+
+// record records the DPoP proof and the jti of a one-time token of a
+// granted request. Only granted tokens and proofs are recorded, such
+// that a denied request does not consume a one-time token.
+func (o Options) record(ctx context.Context, res authResult) authResult {
+	if err := o.recordDPoPProof(ctx); err != nil {
+		infow("DPoP proof rejected", "flow_id", FlowIDFromContext(ctx), "uid", res.uid(), "reason", err)
+		res.err = err
+	} else if err := o.checkReplay(res.tc); err != nil {
+		infow("Token replayed", "flow_id", FlowIDFromContext(ctx), "uid", res.uid(), "reason", err)
+		res.err = err
+	}
+	return res
+}
+
+// authorize runs verify bounded by VarianceTimer. A granted request is
+// only recorded if its result is returned, such that a client retrying
+// after a timeout is not rejected as replay.
+func authorize(ctx context.Context, o Options, token *oauth2.Token, checks []namedCheck) authResult {
+	varianceControl := make(chan authResult, 1)
+	var (
+		mu       sync.Mutex
+		timedOut bool
+	)
+	go func() {
+		res := verify(ctx, o, token, checks)
+		mu.Lock()
+		defer mu.Unlock()
+		if res.err == nil && !timedOut {
+			res = o.record(ctx, res)
+		}
+		varianceControl <- res
+	}()
+
+	select {
+	case res := <-varianceControl:
+		return res
+	case <-time.After(VarianceTimer):
+		mu.Lock()
+		timedOut = true
+		mu.Unlock()
+		// the result may have been recorded while waiting for mu
+		select {
+		case res := <-varianceControl:
+			return res
+		default:
+			return authResult{err: newAuthError(http.StatusGatewayTimeout, ErrTimeout, nil)}
+		}
+	}
+}
+
+// Verify validates token with the tokeninfo service configured in o
+// and runs the checks. It returns the TokenContainer and nil if one of
+// the checks granted access and an *AuthError otherwise. If only the
+// checks failed, the TokenContainer is returned with the error. Verify
+// is the building block for integrations with other frameworks.
+func Verify(ctx context.Context, o Options, token *oauth2.Token, checks ...CheckFunction) (*TokenContainer, error) {
+	named := make([]namedCheck, len(checks))
+	for i, fn := range checks {
+		named[i] = namedCheck{name: funcName(fn), fn: fn}
+	}
+	res := authorize(WithRequestCache(o.withServiceTokenSource(ctx)), o, token, named)
+	if res.err != nil {
+		return res.tc, res.err
+	}
+	return res.tc, nil
+}
+
+// requestContext returns the context of the *http.Request if ctx is a
+// *gin.Context. Values stored in the request context are only visible
+// via gin.Context.Value if gin.Engine.ContextWithFallback is set.
+func requestContext(ctx context.Context) context.Context {
+	if gc, ok := ctx.(*gin.Context); ok && gc.Request != nil {
+		return gc.Request.Context()
+	}
+	return ctx
+}
+
+type requestKey struct{}
+
+// WithRequest returns a copy of ctx carrying r, such that checks like
+// Ownership can read the request outside of the gin middleware.
+// Handler sets it, callers of Verify set it themselves.
+func WithRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, r)
+}
+
+// RequestFromContext returns the request of a *gin.Context or the
+// request set by WithRequest.
+func RequestFromContext(ctx context.Context) (*http.Request, bool) {
+	if gc, ok := ctx.(*gin.Context); ok && gc.Request != nil {
+		return gc.Request, true
+	}
+	r, ok := ctx.Value(requestKey{}).(*http.Request)
+	return r, ok && r != nil
+}
+
+type requestCacheKey struct{}
+
+// WithRequestCache returns a copy of ctx carrying an empty cache for
+// values computed once per request, see RequestCache. If ctx already
+// carries one, ctx is returned. The middlewares, Verify and grpcauth
+// set it before the checks run.
+func WithRequestCache(ctx context.Context) context.Context {
+	if RequestCache(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestCacheKey{}, &sync.Map{})
+}
+
+// RequestCache returns the cache of the request of ctx or nil. Checks
+// and handlers share it, p.e. to look up the teams of a token once per
+// request. Keys should be of unexported types, like context keys.
+func RequestCache(ctx context.Context) *sync.Map {
+	m, _ := requestContext(ctx).Value(requestCacheKey{}).(*sync.Map)
+	return m
+}
+
+// WithTokenContainer returns a copy of ctx carrying tc, see
+// TokenContainerFromContext, and an empty cache for Claims.
+func WithTokenContainer(ctx context.Context, tc *TokenContainer) context.Context {
+	ctx = context.WithValue(ctx, tokenContainerKey{}, tc)
+	return context.WithValue(ctx, claimsCacheKey{}, &claimsCache{decoded: make(map[reflect.Type]claimsResult)})
+}
@@ -0,0 +1,303 @@
+package ginoauth2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrRevoked is returned if the token matches an entry of
+// Options.DenyList.
+var ErrRevoked = errors.New("token revoked")
+
+// DenyKind selects what a DenyEntry matches.
+type DenyKind string
+
+const (
+	DenyTokenHash DenyKind = "token_hash" // hex SHA-256 of the access token, see TokenHash
+	DenyJTI       DenyKind = "jti"        // jti claim of a JWT access token
+	DenySubject   DenyKind = "uid"        // uid of the TokenContainer or sub claim of a JWT
+	DenyClient    DenyKind = "client_id"  // client_id or azp claim of the token
+)
+
+// DenyEntry revokes all tokens matching Kind and Value until Expires.
+// A zero Expires never expires.
+type DenyEntry struct {
+	Kind    DenyKind  `json:"kind"`
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+func (e DenyEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+func (e DenyEntry) validate() error {
+	switch e.Kind {
+	case DenyTokenHash, DenyJTI, DenySubject, DenyClient:
+	default:
+		return fmt.Errorf("unknown deny list kind %q", e.Kind)
+	}
+	if e.Value == "" {
+		return errors.New("deny list entry without value")
+	}
+	return nil
+}
+
+type denyKey struct {
+	kind  DenyKind
+	value string
+}
+
+// TokenHash returns the value of a DenyTokenHash entry for token, such
+// that tokens can be revoked without storing them.
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// DenyList revokes tokens before their expiry. The middleware consults
+// it before the tokeninfo service is called, using the token hash and
+// the unverified claims of JWT access tokens, and again with the uid
+// and client_id of the TokenContainer. Entries are added with Add, by
+// the admin API of AdminHandler or loaded from a file, see
+// NewFileDenyList.
+type DenyList struct {
+	mu      sync.RWMutex
+	entries map[denyKey]DenyEntry
+	file    *fileCache[map[denyKey]DenyEntry]
+}
+
+// denyFileCheckInterval limits how often a file based DenyList checks
+// its file for changes.
+var denyFileCheckInterval = time.Second
+
+// NewDenyList returns an empty DenyList.
+func NewDenyList() *DenyList {
+	return &DenyList{entries: make(map[denyKey]DenyEntry)}
+}
+
+// NewFileDenyList returns a DenyList with the entries of the JSON array
+// of DenyEntry in path. The file is re-read if it changes and at least
+// every interval, which defaults to DefaultFileReloadInterval, but
+// checked for changes at most once per second. Entries added with Add
+// are kept across reloads.
+//
+// Example file:
+//
+//	[
+//	  {"kind": "jti", "value": "4f1g23a12aa", "reason": "leaked in ticket 42"},
+//	  {"kind": "uid", "value": "sszuecs", "expires": "2026-12-01T00:00:00Z"}
+//	]
+func NewFileDenyList(path string, interval time.Duration) (*DenyList, error) {
+	if interval <= 0 {
+		interval = DefaultFileReloadInterval
+	}
+	d := NewDenyList()
+	d.file = &fileCache[map[denyKey]DenyEntry]{
+		paths:      []string{path},
+		interval:   interval,
+		load:       func() (map[denyKey]DenyEntry, error) { return readDenyFile(path) },
+		valid:      func(map[denyKey]DenyEntry) bool { return true },
+		checkEvery: denyFileCheckInterval,
+	}
+	if _, err := d.file.get(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readDenyFile returns the entries of the file by kind and value.
+func readDenyFile(path string) (map[denyKey]DenyEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []DenyEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	res := make(map[denyKey]DenyEntry, len(entries))
+	for _, e := range entries {
+		if err := e.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		res[denyKey{e.Kind, e.Value}] = e
+	}
+	return res, nil
+}
+
+// Add adds or replaces the entry for e.Kind and e.Value.
+func (d *DenyList) Add(e DenyEntry) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[denyKey{e.Kind, e.Value}] = e
+	return nil
+}
+
+// Remove removes the entry added for kind and value. Entries of the
+// file are only removed by changing the file.
+func (d *DenyList) Remove(kind DenyKind, value string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.entries, denyKey{kind, value})
+}
+
+// Entries returns all entries, which did not expire yet.
+func (d *DenyList) Entries() []DenyEntry {
+	now := time.Now()
+	var res []DenyEntry
+	for _, e := range d.fileEntries() {
+		if !e.expired(now) {
+			res = append(res, e)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k, e := range d.entries {
+		if e.expired(now) {
+			delete(d.entries, k)
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+func (d *DenyList) fileEntries() map[denyKey]DenyEntry {
+	if d.file == nil {
+		return nil
+	}
+	entries, err := d.file.get()
+	if err != nil {
+		errorw("failed to load deny list", "path", d.file.paths[0], "error", err)
+	}
+	return entries
+}
+
+// lookup returns the first active entry matching kind and one of the
+// values.
+func (d *DenyList) lookup(kind DenyKind, values ...string) (DenyEntry, bool) {
+	now := time.Now()
+	file := d.fileEntries()
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		d.mu.RLock()
+		e, ok := d.entries[denyKey{kind, v}]
+		d.mu.RUnlock()
+		if ok && !e.expired(now) {
+			return e, true
+		}
+		if e, ok := file[denyKey{kind, v}]; ok && !e.expired(now) {
+			return e, true
+		}
+	}
+	return DenyEntry{}, false
+}
+
+func claimString(claims map[string]interface{}, names ...string) []string {
+	var res []string
+	for _, n := range names {
+		if s, ok := claims[n].(string); ok {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// checkToken matches the raw token and its unverified claims. It is
+// called before the token is validated.
+func (d *DenyList) checkToken(token string) error {
+	if e, ok := d.lookup(DenyTokenHash, TokenHash(token)); ok {
+		return revoked(e)
+	}
+	claims := unverifiedClaims(token)
+	if claims == nil {
+		return nil
+	}
+	if e, ok := d.lookup(DenyJTI, claimString(claims, "jti")...); ok {
+		return revoked(e)
+	}
+	if e, ok := d.lookup(DenySubject, claimString(claims, "sub", "uid")...); ok {
+		return revoked(e)
+	}
+	if e, ok := d.lookup(DenyClient, claimString(claims, "client_id", "azp")...); ok {
+		return revoked(e)
+	}
+	return nil
+}
+
+// checkContainer matches the validated TokenContainer.
+func (d *DenyList) checkContainer(tc *TokenContainer) error {
+	if e, ok := d.lookup(DenySubject, tc.UID(), tc.Subject()); ok {
+		return revoked(e)
+	}
+	if e, ok := d.lookup(DenyClient, tc.ClientID()); ok {
+		return revoked(e)
+	}
+	return nil
+}
+
+// revoked returns the error for a token matching e. The kind of the
+// entry is the reason recorded in the audit log, the value is not
+// logged.
+func revoked(e DenyEntry) *AuthError {
+	ae := newAuthError(http.StatusUnauthorized, ErrRevoked, fmt.Errorf("token revoked by deny list entry %s", e.Kind))
+	ae.Code = "invalid_token"
+	ae.Description = "token revoked"
+	return ae
+}
+
+// AdminHandler returns an http.Handler to manage the entries of d:
+//
+//	GET     lists all entries as JSON array
+//	POST    adds the DenyEntry in the JSON body
+//	DELETE  removes the entry given by the query parameters kind and value
+//
+// The handler does not authorize requests, protect it p.e. with
+// Handler and RequireScopes.
+func (d *DenyList) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			entries := d.Entries()
+			if entries == nil {
+				entries = []DenyEntry{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(entries)
+		case http.MethodPost:
+			var e DenyEntry
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := d.Add(e); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			infow("deny list entry added", "kind", e.Kind, "reason", e.Reason, "flow_id", FlowIDFromContext(r.Context()))
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			kind := DenyKind(r.URL.Query().Get("kind"))
+			d.Remove(kind, r.URL.Query().Get("value"))
+			infow("deny list entry removed", "kind", kind, "flow_id", FlowIDFromContext(r.Context()))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
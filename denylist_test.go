@@ -0,0 +1,145 @@
+package ginoauth2
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestDenyList(t *testing.T) {
+	var tokeninfoCalls int32
+	info := newTokenInfoServer(t, map[string]interface{}{"scope": []interface{}{"uid", "client_id"}, "client_id": "stups_app"})
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokeninfoCalls, 1)
+		http.Redirect(w, r, info.URL+"?"+r.URL.RawQuery, http.StatusTemporaryRedirect)
+	}))
+	defer counting.Close()
+
+	deny := NewDenyList()
+	sink := &memoryAuditSink{}
+	router := newTestRouter(Options{Endpoint: oauth2.Endpoint{TokenURL: counting.URL}, AuditSink: sink, DenyList: deny}, allowAll)
+	assert.Equal(t, http.StatusOK, doRequest(router, bearer("token")).Code)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&tokeninfoCalls))
+
+	// revoked tokens are rejected before tokeninfo is called
+	require.NoError(t, deny.Add(DenyEntry{Kind: DenyTokenHash, Value: TokenHash("token"), Reason: "leaked"}))
+	w := doRequest(router, bearer("token"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer error="invalid_token", error_description="token revoked"`, w.Header().Get("WWW-Authenticate"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&tokeninfoCalls))
+	assert.Equal(t, DecisionDeny, sink.last().Decision)
+	assert.Equal(t, "token revoked by deny list entry token_hash", sink.last().Reason)
+
+	assert.Equal(t, http.StatusOK, doRequest(router, bearer("other")).Code)
+	require.NoError(t, deny.Add(DenyEntry{Kind: DenySubject, Value: "sszuecs"}))
+	assert.Equal(t, http.StatusUnauthorized, doRequest(router, bearer("other")).Code)
+	assert.Equal(t, "token revoked by deny list entry uid", sink.last().Reason)
+	assert.Equal(t, "sszuecs", sink.last().UID)
+	deny.Remove(DenySubject, "sszuecs")
+
+	require.NoError(t, deny.Add(DenyEntry{Kind: DenyClient, Value: "stups_app"}))
+	assert.Equal(t, http.StatusUnauthorized, doRequest(router, bearer("other")).Code)
+	assert.Equal(t, "token revoked by deny list entry client_id", sink.last().Reason)
+	deny.Remove(DenyClient, "stups_app")
+
+	// entries expire
+	require.NoError(t, deny.Add(DenyEntry{Kind: DenyTokenHash, Value: TokenHash("token"), Expires: time.Now().Add(-time.Second)}))
+	assert.Equal(t, http.StatusOK, doRequest(router, bearer("token")).Code)
+	assert.Empty(t, deny.Entries())
+}
+
+func TestDenyListJWTClaims(t *testing.T) {
+	deny := NewDenyList()
+	payload, _ := json.Marshal(map[string]interface{}{"jti": "id-1", "sub": "svc", "azp": "app"})
+	jwt := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+
+	assert.NoError(t, deny.checkToken(jwt))
+	for _, e := range []DenyEntry{
+		{Kind: DenyJTI, Value: "id-1"},
+		{Kind: DenySubject, Value: "svc"},
+		{Kind: DenyClient, Value: "app"},
+	} {
+		require.NoError(t, deny.Add(e))
+		assert.ErrorIs(t, deny.checkToken(jwt), ErrRevoked, e.Kind)
+		deny.Remove(e.Kind, e.Value)
+	}
+
+	assert.Error(t, deny.Add(DenyEntry{Kind: "email", Value: "x"}))
+	assert.Error(t, deny.Add(DenyEntry{Kind: DenyJTI}))
+}
+
+func TestFileDenyList(t *testing.T) {
+	defer func(d time.Duration) { denyFileCheckInterval = d }(denyFileCheckInterval)
+	denyFileCheckInterval = 0
+	path := filepath.Join(t.TempDir(), "deny.json")
+	rotate(t, path, `[{"kind":"jti","value":"id-1"}]`)
+	deny, err := NewFileDenyList(path, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, deny.Add(DenyEntry{Kind: DenyJTI, Value: "id-3"}))
+
+	_, ok := deny.lookup(DenyJTI, "id-1")
+	assert.True(t, ok)
+
+	rotate(t, path, `[{"kind":"jti","value":"id-2"}]`)
+	_, ok = deny.lookup(DenyJTI, "id-1")
+	assert.False(t, ok)
+	_, ok = deny.lookup(DenyJTI, "id-2")
+	assert.True(t, ok)
+	_, ok = deny.lookup(DenyJTI, "id-3")
+	assert.True(t, ok)
+
+	require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(path), "broken.json"), []byte(`[{"kind":"nope","value":"x"}]`), 0600))
+	_, err = NewFileDenyList(filepath.Join(filepath.Dir(path), "broken.json"), 0)
+	assert.Error(t, err)
+}
+
+func TestFileDenyListCheckInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.json")
+	rotate(t, path, `[{"kind":"jti","value":"id-1"}]`)
+	deny, err := NewFileDenyList(path, time.Hour)
+	require.NoError(t, err)
+
+	// the file is not checked again within denyFileCheckInterval
+	rotate(t, path, `[{"kind":"jti","value":"id-2"}]`)
+	_, ok := deny.lookup(DenyJTI, "id-1")
+	assert.True(t, ok)
+}
+
+func TestDenyListAdminHandler(t *testing.T) {
+	deny := NewDenyList()
+	h := deny.AdminHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"kind":"uid","value":"sszuecs","reason":"left"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"kind":"uid"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	var entries []DenyEntry
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&entries))
+	assert.Equal(t, []DenyEntry{{Kind: DenySubject, Value: "sszuecs", Reason: "left"}}, entries)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/?kind=uid&value=sszuecs", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, deny.Entries())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,299 @@
+package ginoauth2
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	// ErrInvalidDPoPProof is returned if the DPoP header of a request
+	// is missing or invalid.
+	ErrInvalidDPoPProof = errors.New("invalid DPoP proof")
+	// ErrUseDPoPNonce is returned if the DPoP proof does not carry the
+	// current nonce of DPoPConfig.Nonce.
+	ErrUseDPoPNonce = errors.New("DPoP proof requires a server nonce")
+)
+
+// DefaultDPoPAlgorithms are the JWS algorithms accepted for DPoP
+// proofs.
+var DefaultDPoPAlgorithms = []string{"ES256", "ES384", "ES512", "RS256", "PS256", "EdDSA"}
+
+// DPoPConfig enables DPoP proof-of-possession tokens (RFC 9449), see
+// Options.DPoP.
+type DPoPConfig struct {
+	// Required rejects bearer tokens, only DPoP bound tokens are
+	// accepted.
+	Required bool
+	// Algorithms accepted for proofs, defaults to
+	// DefaultDPoPAlgorithms.
+	Algorithms []string
+	// MaxAge is the accepted age of a proof by its iat claim, defaults
+	// to one minute.
+	MaxAge time.Duration
+	// Leeway is the allowed clock skew for iat, defaults to 5 seconds.
+	Leeway time.Duration
+	// ReplayStore remembers the jti of proofs of granted requests.
+	// Defaults to a MemoryReplayStore shared by all middlewares, set a
+	// shared store for services with multiple instances.
+	ReplayStore ReplayStore
+	// Nonce, if set, returns the current server nonce. Proofs must
+	// carry it in the nonce claim, otherwise the request is rejected
+	// with error="use_dpop_nonce" and the DPoP-Nonce header.
+	Nonce func() string
+	// BaseURL is the external URL of the service, p.e.
+	// "https://api.example.org", used to check the htu claim behind a
+	// TLS terminating proxy. Defaults to the scheme and Host of the
+	// request.
+	BaseURL string
+}
+
+func (c *DPoPConfig) algorithms() []string {
+	if len(c.Algorithms) == 0 {
+		return DefaultDPoPAlgorithms
+	}
+	return c.Algorithms
+}
+
+// defaultDPoPReplayStore is used if no DPoPConfig.ReplayStore is
+// configured.
+var defaultDPoPReplayStore = NewMemoryReplayStore()
+
+func (c *DPoPConfig) replayStore() ReplayStore {
+	if c.ReplayStore == nil {
+		return defaultDPoPReplayStore
+	}
+	return c.ReplayStore
+}
+
+func dpopError(class error, code, description string) *AuthError {
+	ae := newAuthError(http.StatusUnauthorized, class, nil)
+	ae.Code = code
+	ae.Description = description
+	return ae
+}
+
+func isDPoP(token *oauth2.Token) bool {
+	return token != nil && strings.EqualFold(token.TokenType, "DPoP")
+}
+
+type dpopProofKey struct{}
+
+// dpopProof is a verified DPoP proof, which is recorded in the
+// ReplayStore once the request is granted.
+type dpopProof struct {
+	jkt string    // thumbprint of the proof key
+	jti string    // replay key of the proof
+	exp time.Time // time until the proof has to be remembered
+}
+
+// dpopProofFromContext returns the verified DPoP proof of the request.
+func dpopProofFromContext(ctx context.Context) (dpopProof, bool) {
+	p, ok := requestContext(ctx).Value(dpopProofKey{}).(dpopProof)
+	return p, ok
+}
+
+// checkDPoP verifies the DPoP proof of r for token and returns r with
+// the proof in its context.
+func (o Options) checkDPoP(r *http.Request, token *oauth2.Token) (*http.Request, error) {
+	if o.DPoP == nil {
+		return r, nil
+	}
+	if !isDPoP(token) {
+		if o.DPoP.Required {
+			return r, dpopError(ErrInvalidToken, "invalid_token", "DPoP bound token required")
+		}
+		return r, nil
+	}
+	proof, err := o.DPoP.verifyProof(r, token)
+	if err != nil {
+		return r, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), dpopProofKey{}, proof)), nil
+}
+
+// htu returns the URL of r without query and fragment.
+func (c *DPoPConfig) htu(r *http.Request) string {
+	base := c.BaseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return strings.TrimSuffix(base, "/") + r.URL.EscapedPath()
+}
+
+// verifyProof validates the DPoP header of r as described in RFC 9449
+// section 4.3, except the replay check, see recordDPoPProof.
+func (c *DPoPConfig) verifyProof(r *http.Request, token *oauth2.Token) (dpopProof, error) {
+	invalid := func(description string) (dpopProof, error) {
+		return dpopProof{}, dpopError(ErrInvalidDPoPProof, "invalid_dpop_proof", description)
+	}
+
+	proofs := r.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		return invalid("exactly one DPoP proof required")
+	}
+	jwt, err := parseJWT(proofs[0])
+	if err != nil {
+		return invalid("malformed DPoP proof")
+	}
+	if jwt.header.Typ != "dpop+jwt" {
+		return invalid("DPoP proof has wrong typ")
+	}
+	allowed := false
+	for _, alg := range c.algorithms() {
+		allowed = allowed || alg == jwt.header.Alg
+	}
+	if !allowed {
+		return invalid("DPoP proof algorithm not allowed")
+	}
+	var key jwk
+	if err := json.Unmarshal(jwt.header.JWK, &key); err != nil || key.D != "" {
+		return invalid("DPoP proof has no valid public jwk")
+	}
+	pub, err := key.publicKey()
+	if err != nil {
+		return invalid("DPoP proof has no valid public jwk")
+	}
+	if err := jwt.verify(pub); err != nil {
+		return invalid("invalid DPoP proof signature")
+	}
+
+	if htm, _ := jwt.claims["htm"].(string); htm != r.Method {
+		return invalid("DPoP proof htm mismatch")
+	}
+	if htu, _ := jwt.claims["htu"].(string); stripQuery(htu) != c.htu(r) {
+		return invalid("DPoP proof htu mismatch")
+	}
+
+	maxAge, leeway := c.MaxAge, c.Leeway
+	if maxAge <= 0 {
+		maxAge = time.Minute
+	}
+	if leeway <= 0 {
+		leeway = 5 * time.Second
+	}
+	iat, ok := jwt.claims["iat"].(float64)
+	if !ok {
+		return invalid("DPoP proof has no iat")
+	}
+	issued := time.Unix(int64(iat), 0)
+	now := time.Now()
+	if issued.After(now.Add(leeway)) || issued.Before(now.Add(-maxAge-leeway)) {
+		return invalid("DPoP proof expired")
+	}
+
+	ath := sha256.Sum256([]byte(token.AccessToken))
+	if got, _ := jwt.claims["ath"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(base64.RawURLEncoding.EncodeToString(ath[:]))) != 1 {
+		return invalid("DPoP proof ath mismatch")
+	}
+
+	if c.Nonce != nil {
+		if nonce, _ := jwt.claims["nonce"].(string); nonce == "" || nonce != c.Nonce() {
+			return dpopProof{}, dpopError(ErrUseDPoPNonce, "use_dpop_nonce", "DPoP proof requires a server nonce")
+		}
+	}
+
+	jkt, err := key.thumbprint()
+	if err != nil {
+		return invalid("DPoP proof has no valid public jwk")
+	}
+	jti, _ := jwt.claims["jti"].(string)
+	if jti == "" {
+		return invalid("DPoP proof has no jti")
+	}
+	return dpopProof{jkt: jkt, jti: "dpop:" + jkt + ":" + jti, exp: issued.Add(maxAge + 2*leeway)}, nil
+}
+
+// recordDPoPProof records the jti of the DPoP proof of a granted
+// request and rejects proofs which were used before. Proofs of denied
+// requests are not recorded, such that they do not fill the
+// ReplayStore.
+func (o Options) recordDPoPProof(ctx context.Context) error {
+	if o.DPoP == nil {
+		return nil
+	}
+	proof, ok := dpopProofFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	seen, err := o.DPoP.replayStore().Seen(proof.jti, proof.exp)
+	if err != nil {
+		return replayUnavailable(err)
+	}
+	if seen {
+		return dpopError(ErrInvalidDPoPProof, "invalid_dpop_proof", "DPoP proof replayed")
+	}
+	return nil
+}
+
+func stripQuery(u string) string {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		return u[:i]
+	}
+	return u
+}
+
+// checkDPoPBinding compares the cnf jkt claim of tc with the key of
+// the verified DPoP proof.
+func (o Options) checkDPoPBinding(ctx context.Context, tc *TokenContainer) error {
+	if o.DPoP == nil {
+		return nil
+	}
+	want, bound := tc.Confirmation["jkt"].(string)
+	proof, proven := dpopProofFromContext(ctx)
+	got := proof.jkt
+	switch {
+	case bound && !proven:
+		return dpopError(ErrInvalidToken, "invalid_token", "DPoP bound token used as bearer token")
+	case proven && !bound:
+		return dpopError(ErrInvalidToken, "invalid_token", "token is not DPoP bound")
+	case bound && want != got:
+		return dpopError(ErrInvalidToken, "invalid_token", "DPoP key mismatch")
+	}
+	return nil
+}
+
+// challengeScheme returns the authentication scheme of the
+// WWW-Authenticate challenge for a request with token.
+func (o Options) challengeScheme(token *oauth2.Token, ae *AuthError) string {
+	if o.DPoP == nil {
+		return "Bearer"
+	}
+	if isDPoP(token) || o.DPoP.Required || (ae != nil && (errors.Is(ae, ErrInvalidDPoPProof) || errors.Is(ae, ErrUseDPoPNonce))) {
+		return "DPoP"
+	}
+	return "Bearer"
+}
+
+// writeDPoPHeaders adds the DPoP challenge parameters and the current
+// nonce to the response.
+func (o Options) writeDPoPHeaders(h http.Header, scheme string, ae *AuthError) {
+	if o.DPoP == nil {
+		return
+	}
+	if o.DPoP.Nonce != nil {
+		h.Set("DPoP-Nonce", o.DPoP.Nonce())
+	}
+	if ae != nil && scheme == "DPoP" {
+		c := ae.Challenge("DPoP")
+		if c == "" {
+			c = "DPoP"
+		} else {
+			c += ","
+		}
+		h.Set("WWW-Authenticate", fmt.Sprintf("%s algs=%q", c, strings.Join(o.DPoP.algorithms(), " ")))
+	}
+}
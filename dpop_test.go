@@ -0,0 +1,204 @@
+package ginoauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// dpopClient creates DPoP proofs with its own EC key.
+type dpopClient struct {
+	key *ecdsa.PrivateKey
+	jwk map[string]interface{}
+	n   int
+}
+
+func newDPoPClient(t *testing.T) *dpopClient {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	b64 := base64.RawURLEncoding.EncodeToString
+	return &dpopClient{key: key, jwk: map[string]interface{}{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   b64(key.X.FillBytes(make([]byte, 32))),
+		"y":   b64(key.Y.FillBytes(make([]byte, 32))),
+	}}
+}
+
+func (c *dpopClient) thumbprint(t *testing.T) string {
+	k := jwk{Kty: "EC", Crv: "P-256", X: c.jwk["x"].(string), Y: c.jwk["y"].(string)}
+	jkt, err := k.thumbprint()
+	require.NoError(t, err)
+	return jkt
+}
+
+// proof returns a DPoP proof for token, modified by the given claims.
+func (c *dpopClient) proof(t *testing.T, method, url, token string, extra map[string]interface{}) string {
+	c.n++
+	ath := sha256.Sum256([]byte(token))
+	claims := map[string]interface{}{
+		"jti": time.Now().Format(time.RFC3339Nano) + string(rune('a'+c.n)),
+		"htm": method,
+		"htu": url,
+		"iat": time.Now().Unix(),
+		"ath": base64.RawURLEncoding.EncodeToString(ath[:]),
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return signJWT(t, map[string]interface{}{"typ": "dpop+jwt", "alg": "ES256", "jwk": c.jwk}, claims, func(input []byte) []byte {
+		sum := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, c.key, sum[:])
+		require.NoError(t, err)
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	})
+}
+
+const dpopURL = "http://example.com/private/1"
+
+func dpop(token, proof string) http.Header {
+	h := http.Header{"Authorization": {"DPoP " + token}}
+	if proof != "" {
+		h.Set("DPoP", proof)
+	}
+	return h
+}
+
+func TestDPoP(t *testing.T) {
+	client := newDPoPClient(t)
+	srv := newTokenInfoServer(t, map[string]interface{}{"cnf": map[string]interface{}{"jkt": client.thumbprint(t)}})
+	router := newTestRouter(Options{
+		Endpoint: oauth2.Endpoint{TokenURL: srv.URL},
+		DPoP:     &DPoPConfig{ReplayStore: NewMemoryReplayStore()},
+	}, allowAll)
+
+	proof := client.proof(t, http.MethodGet, dpopURL, "token", nil)
+	assert.Equal(t, http.StatusOK, doRequest(router, dpop("token", proof)).Code)
+	assert.Equal(t, http.StatusOK, doRequest(router, dpop("token", client.proof(t, http.MethodGet, dpopURL+"?q=1", "token", nil))).Code)
+
+	w := doRequest(router, dpop("token", proof))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `DPoP error="invalid_dpop_proof", error_description="DPoP proof replayed", algs="ES256 ES384 ES512 RS256 PS256 EdDSA"`, w.Header().Get("WWW-Authenticate"))
+
+	other := newDPoPClient(t)
+	for name, tt := range map[string]struct {
+		header      http.Header
+		description string
+	}{
+		"missing proof":  {dpop("token", ""), "exactly one DPoP proof required"},
+		"htm":            {dpop("token", client.proof(t, http.MethodPost, dpopURL, "token", nil)), "DPoP proof htm mismatch"},
+		"htu":            {dpop("token", client.proof(t, http.MethodGet, "http://example.com/private/2", "token", nil)), "DPoP proof htu mismatch"},
+		"ath":            {dpop("token", client.proof(t, http.MethodGet, dpopURL, "other-token", nil)), "DPoP proof ath mismatch"},
+		"old":            {dpop("token", client.proof(t, http.MethodGet, dpopURL, "token", map[string]interface{}{"iat": time.Now().Add(-2 * time.Minute).Unix()})), "DPoP proof expired"},
+		"future":         {dpop("token", client.proof(t, http.MethodGet, dpopURL, "token", map[string]interface{}{"iat": time.Now().Add(time.Minute).Unix()})), "DPoP proof expired"},
+		"no jti":         {dpop("token", client.proof(t, http.MethodGet, dpopURL, "token", map[string]interface{}{"jti": nil})), "DPoP proof has no jti"},
+		"typ":            {dpop("token", signJWT(t, map[string]interface{}{"typ": "JWT", "alg": "ES256", "jwk": client.jwk}, map[string]interface{}{}, func([]byte) []byte { return nil })), "DPoP proof has wrong typ"},
+		"alg":            {dpop("token", signJWT(t, map[string]interface{}{"typ": "dpop+jwt", "alg": "HS256", "jwk": client.jwk}, map[string]interface{}{}, func([]byte) []byte { return nil })), "DPoP proof algorithm not allowed"},
+		"signature":      {dpop("token", signJWT(t, map[string]interface{}{"typ": "dpop+jwt", "alg": "ES256", "jwk": client.jwk}, map[string]interface{}{}, func([]byte) []byte { return make([]byte, 64) })), "invalid DPoP proof signature"},
+		"key mismatch":   {dpop("token", other.proof(t, http.MethodGet, dpopURL, "token", nil)), "DPoP key mismatch"},
+		"used as bearer": {bearer("token"), "DPoP bound token used as bearer token"},
+	} {
+		w := doRequest(router, tt.header)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, name)
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error_description="`+tt.description+`"`, name)
+	}
+
+	// unbound tokens are accepted as bearer tokens, but not with DPoP
+	unbound := newTestRouter(Options{
+		Endpoint: oauth2.Endpoint{TokenURL: newTokenInfoServer(t, nil).URL},
+		DPoP:     &DPoPConfig{ReplayStore: NewMemoryReplayStore()},
+	}, allowAll)
+	assert.Equal(t, http.StatusOK, doRequest(unbound, bearer("token")).Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(unbound, dpop("token", client.proof(t, http.MethodGet, dpopURL, "token", nil))).Code)
+}
+
+func TestDPoPRequired(t *testing.T) {
+	srv := newTokenInfoServer(t, nil)
+	router := newTestRouter(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}, DPoP: &DPoPConfig{Required: true, Algorithms: []string{"ES256"}}}, allowAll)
+
+	w := doRequest(router, bearer("token"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `DPoP error="invalid_token", error_description="DPoP bound token required", algs="ES256"`, w.Header().Get("WWW-Authenticate"))
+
+	w = doRequest(router, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `DPoP algs="ES256"`, w.Header().Get("WWW-Authenticate"))
+}
+
+func TestDPoPProofRecordedAfterGrant(t *testing.T) {
+	client := newDPoPClient(t)
+	srv := newTokenInfoServer(t, map[string]interface{}{"cnf": map[string]interface{}{"jkt": client.thumbprint(t)}})
+	o := Options{
+		Endpoint: oauth2.Endpoint{TokenURL: srv.URL},
+		DPoP:     &DPoPConfig{ReplayStore: NewMemoryReplayStore()},
+	}
+
+	// a proof of a denied request is not consumed
+	proof := client.proof(t, http.MethodGet, dpopURL, "token", nil)
+	assert.Equal(t, http.StatusForbidden, doRequest(newTestRouter(o, denyAll), dpop("token", proof)).Code)
+	assert.Equal(t, 0, o.DPoP.ReplayStore.(*MemoryReplayStore).Len())
+	assert.Equal(t, http.StatusOK, doRequest(newTestRouter(o, allowAll), dpop("token", proof)).Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(newTestRouter(o, allowAll), dpop("token", proof)).Code)
+}
+
+func TestDPoPNonce(t *testing.T) {
+	client := newDPoPClient(t)
+	srv := newTokenInfoServer(t, map[string]interface{}{"cnf": map[string]interface{}{"jkt": client.thumbprint(t)}})
+	nonce := "n-1"
+	router := newTestRouter(Options{
+		Endpoint: oauth2.Endpoint{TokenURL: srv.URL},
+		DPoP:     &DPoPConfig{Nonce: func() string { return nonce }},
+	}, allowAll)
+
+	w := doRequest(router, dpop("token", client.proof(t, http.MethodGet, dpopURL, "token", nil)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "n-1", w.Header().Get("DPoP-Nonce"))
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `DPoP error="use_dpop_nonce"`)
+
+	w = doRequest(router, dpop("token", client.proof(t, http.MethodGet, dpopURL, "token", map[string]interface{}{"nonce": "n-1"})))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "n-1", w.Header().Get("DPoP-Nonce"))
+}
+
+func TestDPoPHandler(t *testing.T) {
+	client := newDPoPClient(t)
+	srv := newTokenInfoServer(t, map[string]interface{}{"cnf": map[string]interface{}{"jkt": client.thumbprint(t)}})
+	h := Handler(Options{
+		Endpoint: oauth2.Endpoint{TokenURL: srv.URL},
+		DPoP:     &DPoPConfig{BaseURL: "https://api.example.org/"},
+	}, allowAllContext)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/private/1", nil)
+	r.Header = dpop("token", client.proof(t, http.MethodGet, "https://api.example.org/private/1", "token", nil))
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// RFC 7638, section 3.1
+	k := jwk{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		Kid: "2011-04-29",
+	}
+	jkt, err := k.thumbprint()
+	require.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", jkt)
+}
@@ -36,7 +36,10 @@ func main() {
 	sessionName := "goquestsession"
 	router := gin.Default()
 	// init settings for github auth
-	github.Setup(redirectURL, credFile, scopes, secret)
+	if err := github.Setup(redirectURL, credFile, scopes, secret); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 	router.Use(github.Session(sessionName))
 
 	router.GET("/login", github.LoginHandler)
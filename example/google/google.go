@@ -38,7 +38,10 @@ func main() {
 
 	router := gin.Default()
 	// init settings for google auth
-	google.Setup(redirectURL, credFile, scopes, secret)
+	if err := google.Setup(redirectURL, credFile, scopes, secret); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 	router.Use(google.Session(sessionName))
 
 	router.GET("/login", google.LoginHandler)
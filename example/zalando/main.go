@@ -55,7 +55,7 @@ func main() {
 	flag.Parse()
 	router := gin.New()
 	router.Use(ginglog.Logger(3 * time.Second))
-	router.Use(ginoauth2.RequestLogger([]string{"uid"}, "data"))
+	router.Use(ginoauth2.RequestLoggerWithConfig(ginoauth2.RequestLoggerConfig{ContentKey: "data"}))
 	router.Use(gin.Recovery())
 
 	ginoauth2.VarianceTimer = 300 * time.Millisecond // defaults to 30s
@@ -81,22 +81,22 @@ func main() {
 		c.JSON(200, gin.H{"message": "Hello from private for groups and users"})
 	})
 	privateGroup.GET("/", func(c *gin.Context) {
-		uid, okUID := c.Get("uid")
-		if team, ok := c.Get("team"); ok && okUID {
+		uid, team := zalando.UID(c), zalando.Team(c)
+		if uid != "" && team != "" {
 			c.JSON(200, gin.H{"message": fmt.Sprintf("Hello from private for groups to %s member of %s", uid, team)})
 		} else {
 			c.JSON(200, gin.H{"message": "Hello from private for groups without uid and team"})
 		}
 	})
 	privateUser.GET("/", func(c *gin.Context) {
-		if v, ok := c.Get("cn"); ok {
+		if v := zalando.Cn(c); v != "" {
 			c.JSON(200, gin.H{"message": fmt.Sprintf("Hello from private for users to %s", v)})
 		} else {
 			c.JSON(200, gin.H{"message": "Hello from private for users without cn"})
 		}
 	})
 	privateService.GET("/", func(c *gin.Context) {
-		if v, ok := c.Get("cn"); ok {
+		if v := zalando.Cn(c); v != "" {
 			c.JSON(200, gin.H{"message": fmt.Sprintf("Hello from private for services to %s", v)})
 		} else {
 			c.JSON(200, gin.H{"message": "Hello from private for services without cn"})
@@ -0,0 +1,305 @@
+package ginoauth2
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// DefaultFileReloadInterval is the interval at which file based
+// credentials are re-read, even if the files did not change.
+const DefaultFileReloadInterval = time.Minute
+
+// fileCache caches a value loaded from files. The value is reloaded if
+// one of the files changed, the reload interval passed or it is no
+// longer valid.
+type fileCache[T any] struct {
+	paths    []string
+	interval time.Duration
+	load     func() (T, error)
+	valid    func(T) bool
+	// checkEvery skips the check of the files for this duration after
+	// the last check, p.e. for values read on every request.
+	checkEvery time.Duration
+
+	mu        sync.Mutex
+	loaded    bool
+	value     T
+	version   string
+	loadedAt  time.Time
+	checkedAt time.Time
+}
+
+// fileVersion identifies the content of paths by modification time
+// and size. Mounted secrets are replaced by swapping a symlink, which
+// os.Stat follows.
+func fileVersion(paths []string) (string, error) {
+	var sb strings.Builder
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "%d:%d;", fi.ModTime().UnixNano(), fi.Size())
+	}
+	return sb.String(), nil
+}
+
+func (c *fileCache[T]) get() (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.loaded && c.checkEvery > 0 && time.Since(c.checkedAt) < c.checkEvery && c.valid(c.value) {
+		return c.value, nil
+	}
+	c.checkedAt = time.Now()
+	version, err := fileVersion(c.paths)
+	if err == nil && c.loaded && version == c.version && time.Since(c.loadedAt) < c.interval && c.valid(c.value) {
+		return c.value, nil
+	}
+	if err == nil {
+		var v T
+		v, err = c.load()
+		if err == nil {
+			c.loaded, c.value, c.version, c.loadedAt = true, v, version, time.Now()
+			return v, nil
+		}
+	}
+
+	// keep serving the last value while files are rotated
+	if c.loaded && c.valid(c.value) {
+		errorw("reload of credentials failed, using cached value", "path", strings.Join(c.paths, ","), "error", err)
+		return c.value, nil
+	}
+	var zero T
+	return zero, err
+}
+
+func readTrimmed(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// validateSecret rejects empty secrets and secrets containing
+// whitespace or control characters, p.e. of a partially written file.
+func validateSecret(path, s string) error {
+	if s == "" {
+		return fmt.Errorf("%s is empty", path)
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("%s contains invalid characters", path)
+		}
+	}
+	return nil
+}
+
+// unverifiedClaims returns the claims of a JWT shaped token without
+// verifying its signature, or nil if token is not a JWT.
+func unverifiedClaims(token string) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil
+	}
+	return claims
+}
+
+// jwtExpiry returns the exp claim of a JWT shaped token.
+func jwtExpiry(token string) (time.Time, bool) {
+	exp, ok := unverifiedClaims(token)["exp"].(float64)
+	if !ok || exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(exp), 0), true
+}
+
+// ErrTokenExpired is returned by a FileTokenSource if the token read
+// from disk is expired.
+var ErrTokenExpired = errors.New("token expired")
+
+// FileTokenSource is an oauth2.TokenSource reading the token from
+// files, p.e. mounted by the platform into a pod. The files are re-read
+// if they change, at least every reload interval and whenever the
+// cached token expired. If the token is a JWT its exp claim sets the
+// expiry, such that an expired token is never returned.
+type FileTokenSource struct {
+	cache *fileCache[*oauth2.Token]
+}
+
+// NewFileTokenSource returns a FileTokenSource reading the token from
+// the file path. The file contains only the token, p.e.
+// $HOME/.chimp-token. interval defaults to DefaultFileReloadInterval.
+func NewFileTokenSource(path string, interval time.Duration) *FileTokenSource {
+	return newFileTokenSource([]string{path}, interval, func() (*oauth2.Token, error) {
+		return readToken(path, "")
+	})
+}
+
+// NewCredentialsDirTokenSource returns a FileTokenSource reading the
+// token name from the credentials directory dir, which contains the
+// files <name>-token-secret and <name>-token-type, p.e.
+// NewCredentialsDirTokenSource("/meta/credentials", "teams", 0).
+func NewCredentialsDirTokenSource(dir, name string, interval time.Duration) *FileTokenSource {
+	secret := filepath.Join(dir, name+"-token-secret")
+	typ := filepath.Join(dir, name+"-token-type")
+	return newFileTokenSource([]string{secret, typ}, interval, func() (*oauth2.Token, error) {
+		return readToken(secret, typ)
+	})
+}
+
+func newFileTokenSource(paths []string, interval time.Duration, load func() (*oauth2.Token, error)) *FileTokenSource {
+	if interval <= 0 {
+		interval = DefaultFileReloadInterval
+	}
+	return &FileTokenSource{cache: &fileCache[*oauth2.Token]{
+		paths:    paths,
+		interval: interval,
+		load:     load,
+		valid:    func(t *oauth2.Token) bool { return t.Valid() },
+	}}
+}
+
+func readToken(secretPath, typePath string) (*oauth2.Token, error) {
+	secret, err := readTrimmed(secretPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSecret(secretPath, secret); err != nil {
+		return nil, err
+	}
+	tok := &oauth2.Token{AccessToken: secret, TokenType: "Bearer"}
+	if typePath != "" {
+		typ, err := readTrimmed(typePath)
+		if err != nil {
+			return nil, err
+		}
+		if typ != "" {
+			tok.TokenType = typ
+		}
+	}
+	if exp, ok := jwtExpiry(secret); ok {
+		tok.Expiry = exp
+	}
+	if !tok.Valid() {
+		return nil, fmt.Errorf("%s: %w", secretPath, ErrTokenExpired)
+	}
+	return tok, nil
+}
+
+// Token returns the current token from disk.
+func (s *FileTokenSource) Token() (*oauth2.Token, error) {
+	return s.cache.get()
+}
+
+// ClientCredentials identify the service itself to the authorization
+// server.
+type ClientCredentials struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// FileCredentials provides ClientCredentials read from disk. Like
+// FileTokenSource it re-reads them if they change and at least every
+// reload interval.
+type FileCredentials struct {
+	cache *fileCache[ClientCredentials]
+}
+
+// NewFileCredentials returns FileCredentials read from path. path is
+// either a JSON file with client_id and client_secret, p.e.
+// /meta/credentials/client.json, or a directory with the files
+// client-id and client-secret, p.e. a mounted Kubernetes Secret.
+// interval defaults to DefaultFileReloadInterval.
+func NewFileCredentials(path string, interval time.Duration) *FileCredentials {
+	if interval <= 0 {
+		interval = DefaultFileReloadInterval
+	}
+	c := &fileCache[ClientCredentials]{
+		paths:    []string{path},
+		interval: interval,
+		valid:    func(ClientCredentials) bool { return true },
+	}
+	c.load = func() (ClientCredentials, error) {
+		return readClientCredentials(path)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		id, secret := filepath.Join(path, "client-id"), filepath.Join(path, "client-secret")
+		c.paths = []string{id, secret}
+		c.load = func() (ClientCredentials, error) {
+			return readClientCredentialsDir(id, secret)
+		}
+	}
+	return &FileCredentials{cache: c}
+}
+
+func readClientCredentials(path string) (ClientCredentials, error) {
+	var cc ClientCredentials
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cc, err
+	}
+	if err := json.Unmarshal(b, &cc); err != nil {
+		return cc, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateSecret(path+" client_id", cc.ClientID); err != nil {
+		return cc, err
+	}
+	return cc, validateSecret(path+" client_secret", cc.ClientSecret)
+}
+
+func readClientCredentialsDir(idPath, secretPath string) (ClientCredentials, error) {
+	var cc ClientCredentials
+	var err error
+	if cc.ClientID, err = readTrimmed(idPath); err != nil {
+		return cc, err
+	}
+	if cc.ClientSecret, err = readTrimmed(secretPath); err != nil {
+		return cc, err
+	}
+	if err := validateSecret(idPath, cc.ClientID); err != nil {
+		return cc, err
+	}
+	return cc, validateSecret(secretPath, cc.ClientSecret)
+}
+
+// Credentials returns the current ClientCredentials from disk.
+func (f *FileCredentials) Credentials() (ClientCredentials, error) {
+	return f.cache.get()
+}
+
+// NewFileServiceTokenSource is like NewServiceTokenSource, but takes
+// ClientID and ClientSecret of c from creds on every token request,
+// such that rotated credentials are picked up.
+func NewFileServiceTokenSource(creds *FileCredentials, c clientcredentials.Config, refreshBefore time.Duration) *ServiceTokenSource {
+	return newServiceTokenSource(func(ctx context.Context) (*oauth2.Token, error) {
+		cc, err := creds.Credentials()
+		if err != nil {
+			return nil, err
+		}
+		cfg := c
+		cfg.ClientID, cfg.ClientSecret = cc.ClientID, cc.ClientSecret
+		return clientCredentialsToken(ctx, &cfg)
+	}, refreshBefore)
+}
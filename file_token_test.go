@@ -0,0 +1,195 @@
+package ginoauth2
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+func jwtWithExpiry(exp time.Time) string {
+	payload, _ := json.Marshal(map[string]interface{}{"sub": "svc", "exp": exp.Unix()})
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+// rotate replaces path atomically, like the kubelet does for mounted
+// secrets, and moves the modification time forward.
+func rotate(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte(content), 0600))
+	mtime := time.Now().Add(time.Duration(len(content)) * time.Second)
+	if fi, err := os.Stat(path); err == nil && !mtime.After(fi.ModTime()) {
+		mtime = fi.ModTime().Add(time.Second)
+	}
+	require.NoError(t, os.Chtimes(tmp, mtime, mtime))
+	require.NoError(t, os.Rename(tmp, path))
+}
+
+func TestFileTokenSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	rotate(t, path, "first\n")
+	ts := NewFileTokenSource(path, time.Hour)
+
+	tok, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "first", tok.AccessToken)
+	assert.Equal(t, "Bearer", tok.TokenType)
+
+	rotate(t, path, "second")
+	tok, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "second", tok.AccessToken)
+
+	// a broken file does not replace a valid token
+	rotate(t, path, "not a token")
+	tok, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "second", tok.AccessToken)
+
+	require.NoError(t, os.Remove(path))
+	tok, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "second", tok.AccessToken)
+}
+
+func TestFileTokenSourceInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"empty":   "\n",
+		"spaces":  "two tokens",
+		"expired": jwtWithExpiry(time.Now().Add(-time.Minute)),
+	} {
+		path := filepath.Join(dir, name)
+		rotate(t, path, content)
+		_, err := NewFileTokenSource(path, 0).Token()
+		assert.Error(t, err, name)
+	}
+	_, err := NewFileTokenSource(filepath.Join(dir, "missing"), 0).Token()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFileTokenSourceNeverServesExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	rotate(t, path, jwtWithExpiry(time.Now().Truncate(time.Second).Add(12*time.Second)))
+	ts := NewFileTokenSource(path, time.Hour)
+
+	tok, err := ts.Token()
+	require.NoError(t, err)
+	assert.False(t, tok.Expiry.IsZero())
+
+	// within the expiry delta of oauth2.Token the token is no longer
+	// served, even though the file did not change
+	time.Sleep(2100 * time.Millisecond)
+	_, err = ts.Token()
+	assert.ErrorIs(t, err, ErrTokenExpired)
+
+	fresh := jwtWithExpiry(time.Now().Add(time.Hour))
+	rotate(t, path, fresh)
+	tok, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, fresh, tok.AccessToken)
+}
+
+func TestFileTokenSourceReloadsOnSchedule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("aaaa"), 0600))
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	ts := NewFileTokenSource(path, 10*time.Millisecond)
+
+	tok, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "aaaa", tok.AccessToken)
+
+	// same size and modification time, only the schedule notices it
+	require.NoError(t, os.WriteFile(path, []byte("bbbb"), 0600))
+	require.NoError(t, os.Chtimes(path, fi.ModTime(), fi.ModTime()))
+	tok, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "aaaa", tok.AccessToken)
+
+	time.Sleep(20 * time.Millisecond)
+	tok, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "bbbb", tok.AccessToken)
+}
+
+func TestCredentialsDirTokenSource(t *testing.T) {
+	dir := t.TempDir()
+	rotate(t, filepath.Join(dir, "teams-token-secret"), "secret-1")
+	rotate(t, filepath.Join(dir, "teams-token-type"), "Bearer")
+	ts := NewCredentialsDirTokenSource(dir, "teams", time.Hour)
+
+	tok, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "secret-1", tok.AccessToken)
+
+	rotate(t, filepath.Join(dir, "teams-token-secret"), "secret-2")
+	tok, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "secret-2", tok.AccessToken)
+}
+
+func TestFileCredentials(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "client.json")
+	rotate(t, path, `{"client_id":"svc","client_secret":"s1"}`)
+	creds := NewFileCredentials(path, time.Hour)
+	cc, err := creds.Credentials()
+	require.NoError(t, err)
+	assert.Equal(t, ClientCredentials{ClientID: "svc", ClientSecret: "s1"}, cc)
+
+	rotate(t, path, `{"client_id":"svc","client_secret":"s2-rotated"}`)
+	cc, err = creds.Credentials()
+	require.NoError(t, err)
+	assert.Equal(t, "s2-rotated", cc.ClientSecret)
+
+	_, err = NewFileCredentials(filepath.Join(dir, "missing.json"), 0).Credentials()
+	assert.Error(t, err)
+
+	secretDir := filepath.Join(dir, "secret")
+	require.NoError(t, os.Mkdir(secretDir, 0700))
+	rotate(t, filepath.Join(secretDir, "client-id"), "svc\n")
+	rotate(t, filepath.Join(secretDir, "client-secret"), "")
+	_, err = NewFileCredentials(secretDir, 0).Credentials()
+	assert.Error(t, err)
+	rotate(t, filepath.Join(secretDir, "client-secret"), "s3\n")
+	cc, err = NewFileCredentials(secretDir, 0).Credentials()
+	require.NoError(t, err)
+	assert.Equal(t, ClientCredentials{ClientID: "svc", ClientSecret: "s3"}, cc)
+}
+
+func TestFileServiceTokenSource(t *testing.T) {
+	var secrets []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, secret, _ := r.BasicAuth()
+		secrets = append(secrets, secret)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"tok-%d","token_type":"Bearer","expires_in":3600}`, len(secrets))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "client.json")
+	rotate(t, path, `{"client_id":"svc","client_secret":"s1"}`)
+	creds := NewFileCredentials(path, time.Hour)
+
+	tok, err := NewFileServiceTokenSource(creds, clientcredentials.Config{TokenURL: srv.URL}, 0).Token()
+	require.NoError(t, err)
+	assert.Equal(t, "tok-1", tok.AccessToken)
+
+	rotate(t, path, `{"client_id":"svc","client_secret":"s2-rotated"}`)
+	_, err = NewFileServiceTokenSource(creds, clientcredentials.Config{TokenURL: srv.URL}, 0).Token()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"s1", "s2-rotated"}, secrets)
+}
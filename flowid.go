@@ -0,0 +1,85 @@
+package ginoauth2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+)
+
+// FlowIDHeader is the name of the HTTP header used to correlate
+// requests. The Auth middleware reads it from incoming requests, or
+// generates a new flow ID if it is missing or invalid, and forwards it to the
+// tokeninfo service and the Teams API.
+var FlowIDHeader = "X-Flow-ID"
+
+type flowIDKey struct{}
+
+// NewFlowID returns a random flow ID.
+func NewFlowID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// WithFlowID returns a copy of ctx carrying the given flow ID.
+func WithFlowID(ctx context.Context, flowID string) context.Context {
+	return context.WithValue(ctx, flowIDKey{}, flowID)
+}
+
+// FlowIDFromContext returns the flow ID of the current request or ""
+// if there is none. ctx may be the *gin.Context or the context of the
+// *http.Request.
+func FlowIDFromContext(ctx context.Context) string {
+	id, _ := requestContext(ctx).Value(flowIDKey{}).(string)
+	return id
+}
+
+// maxFlowIDLength limits the length of flow IDs read from requests.
+const maxFlowIDLength = 64
+
+// ValidFlowID reports whether id can be logged and forwarded safely,
+// it has to be short and consist of letters, digits, '-', '_' and '.'.
+// Integrations reading flow IDs from other sources, p.e. gRPC metadata,
+// use it to replace invalid flow IDs with NewFlowID.
+func ValidFlowID(id string) bool {
+	if id == "" || len(id) > maxFlowIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ensureFlowID returns r with a flow ID in its context, taken from an
+// earlier middleware, the FlowIDHeader of the request or generated. A
+// FlowIDHeader which is too long or contains other characters than
+// letters, digits, '-', '_' and '.' is replaced by a new flow ID.
+func ensureFlowID(r *http.Request) (*http.Request, string) {
+	if id := FlowIDFromContext(r.Context()); id != "" {
+		return r, id
+	}
+	id := r.Header.Get(FlowIDHeader)
+	if !ValidFlowID(id) {
+		if id != "" {
+			debugw("Replace invalid flow ID", "length", len(id))
+		}
+		id = NewFlowID()
+	}
+	return r.WithContext(WithFlowID(r.Context(), id)), id
+}
+
+// SetFlowIDHeader sets the FlowIDHeader of an outgoing request to the
+// flow ID found in ctx, if any.
+func SetFlowIDHeader(ctx context.Context, req *http.Request) {
+	if id := FlowIDFromContext(ctx); id != "" && FlowIDHeader != "" {
+		req.Header.Set(FlowIDHeader, id)
+	}
+}
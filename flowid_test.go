@@ -0,0 +1,68 @@
+package ginoauth2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestFlowIDPropagation(t *testing.T) {
+	var received string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(FlowIDHeader)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token", "token_type": "Bearer", "grant_type": "password",
+			"expires_in": float64(3600), "realm": "/employees", "scope": []interface{}{"uid"}, "uid": "sszuecs",
+		})
+	}))
+	defer srv.Close()
+	sink := &memoryAuditSink{}
+	router := newTestRouter(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}, AuditSink: sink}, allowAll)
+
+	t.Run("incoming flow id is forwarded", func(t *testing.T) {
+		hdr := bearer("token")
+		hdr.Set("X-Flow-ID", "JAh6xdAxMQiOXQp1")
+		w := doRequest(router, hdr)
+
+		assert.Equal(t, "JAh6xdAxMQiOXQp1", received)
+		assert.Equal(t, "JAh6xdAxMQiOXQp1", w.Header().Get("X-Flow-ID"))
+		assert.Equal(t, "JAh6xdAxMQiOXQp1", sink.last().FlowID)
+	})
+
+	t.Run("missing flow id is generated", func(t *testing.T) {
+		w := doRequest(router, bearer("token"))
+
+		assert.NotEmpty(t, received)
+		assert.Equal(t, received, w.Header().Get("X-Flow-ID"))
+		assert.Equal(t, received, sink.last().FlowID)
+	})
+
+	t.Run("invalid flow id is replaced", func(t *testing.T) {
+		for _, id := range []string{"evil\nuid=admin", strings.Repeat("a", 65), "<script>"} {
+			hdr := bearer("token")
+			hdr.Set("X-Flow-ID", id)
+			w := doRequest(router, hdr)
+
+			assert.NotEqual(t, id, received)
+			assert.True(t, ValidFlowID(received), received)
+			assert.Equal(t, received, w.Header().Get("X-Flow-ID"))
+		}
+	})
+
+	t.Run("configured header name", func(t *testing.T) {
+		defer func(h string) { FlowIDHeader = h }(FlowIDHeader)
+		FlowIDHeader = "X-Request-ID"
+
+		hdr := bearer("token")
+		hdr.Set("X-Request-ID", "req-1")
+		w := doRequest(router, hdr)
+
+		assert.Equal(t, "req-1", received)
+		assert.Equal(t, "req-1", w.Header().Get("X-Request-ID"))
+	})
+}
@@ -21,7 +21,7 @@
 //	}
 //
 //	func UidCheck(tc *TokenContainer, ctx *gin.Context) bool {
-//	 uid := tc.Scopes["uid"].(string)
+//	 uid := tc.UID()
 //	 if uid != "sszuecs" {
 //	  return false
 //	 }
@@ -53,13 +53,13 @@
 package ginoauth2
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
 	"time"
 
@@ -82,6 +82,18 @@ type TokenContainer struct {
 	Scopes    map[string]interface{} // LDAP record vom Benutzer (cn, ..
 	GrantType string                 // password, ??
 	Realm     string                 // services, employees
+	Audience  []string               // aud of tokeninfo or the JWT access token
+	JTI       string                 // jti, the unique id of the token, if any
+	ACR       string                 // acr, the authentication context class of the login
+	AMR       []string               // amr, the authentication methods of the login, p.e. "mfa"
+	AuthTime  time.Time              // auth_time, the time of the login
+	// RawClaims are all claims of the tokeninfo or introspection
+	// response or the JWT, see Claim.
+	RawClaims map[string]interface{}
+	issuer    string // Issuer.Name of the issuer which validated the token
+	// Confirmation is the cnf claim of a sender-constrained token,
+	// p.e. {"x5t#S256": "..."} for certificate bound tokens.
+	Confirmation map[string]interface{}
 }
 
 // AccessCheckFunction is a function that checks if a given token grants
@@ -91,14 +103,38 @@ type AccessCheckFunction func(tc *TokenContainer, ctx *gin.Context) bool
 type Options struct {
 	Endpoint            oauth2.Endpoint
 	AccessTokenInHeader bool
+	AuditSink           AuditSink // receives access decisions, defaults to DefaultAuditSink
+	// ServiceTokenSource authenticates calls made with the identity of
+	// the service, p.e. to the Teams API, see NewServiceTokenSource.
+	ServiceTokenSource oauth2.TokenSource
+	// Issuers replaces the tokeninfo service of Endpoint by a list of
+	// trusted issuers, each with its own Validator.
+	Issuers []Issuer
+	// CertificateBinding verifies certificate bound tokens against
+	// the TLS client certificate (RFC 8705). Use a separate middleware
+	// per route group to require it only for some routes.
+	CertificateBinding CertificateBinding
+	// DPoP enables DPoP proof-of-possession tokens (RFC 9449).
+	DPoP *DPoPConfig
+	// OneTimeTokens accepts every token only once, p.e. for webhook
+	// senders. The jti of each accepted token is recorded in
+	// ReplayStore until the token expires, tokens without jti are
+	// rejected.
+	OneTimeTokens bool
+	// ReplayStore records the jti of OneTimeTokens, defaults to a
+	// MemoryReplayStore shared by all middlewares.
+	ReplayStore ReplayStore
+	// Audiences, if set, requires the audience of the token to
+	// contain one of them. Tokens issued for other services are
+	// rejected as invalid_token.
+	Audiences []string
+	// DenyList revokes tokens before the tokeninfo service is asked,
+	// see NewDenyList.
+	DenyList *DenyList
 }
 
-var accessTokenMask = regexp.MustCompile("[?&]access_token=[^&]+")
-
 func maskAccessToken(a interface{}) string {
-	s := fmt.Sprint(a)
-	s = accessTokenMask.ReplaceAllString(s, "<MASK>")
-	return s
+	return DefaultRedactor.Redact(fmt.Sprint(a))
 }
 
 func extractToken(r *http.Request) (*oauth2.Token, error) {
@@ -114,21 +150,23 @@ func extractToken(r *http.Request) (*oauth2.Token, error) {
 	return &oauth2.Token{AccessToken: token, TokenType: typ}, nil
 }
 
-func requestAuthInfo(o Options, t *oauth2.Token) ([]byte, error) {
-	var infoURL string
-	if o.AccessTokenInHeader {
+func requestAuthInfo(ctx context.Context, o Options, t *oauth2.Token) ([]byte, error) {
+	infoURL := o.Endpoint.TokenURL
+	if infoURL == "" {
 		infoURL = AuthInfoURL
-	} else {
+	}
+	if !o.AccessTokenInHeader {
 		var uv = make(url.Values)
 		uv.Set("access_token", t.AccessToken)
-		infoURL = AuthInfoURL + "?" + uv.Encode()
+		infoURL = infoURL + "?" + uv.Encode()
 	}
 
 	client := &http.Client{Transport: &Transport}
-	req, err := http.NewRequest("GET", infoURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", infoURL, nil)
 	if err != nil {
 		return nil, err
 	}
+	SetFlowIDHeader(ctx, req)
 
 	if o.AccessTokenInHeader {
 		req.Header.Set("Authorization", "Bearer "+t.AccessToken)
@@ -144,94 +182,161 @@ func requestAuthInfo(o Options, t *oauth2.Token) ([]byte, error) {
 }
 
 func RequestAuthInfo(t *oauth2.Token) ([]byte, error) {
-	return requestAuthInfo(Options{}, t)
+	return requestAuthInfo(context.Background(), Options{}, t)
 }
 
 func ParseTokenContainer(t *oauth2.Token, data map[string]interface{}) (*TokenContainer, error) {
 	tdata := make(map[string]interface{})
 
-	ttype := data["token_type"].(string)
-	gtype := data["grant_type"].(string)
-
-	realm := data["realm"].(string)
-	exp := data["expires_in"].(float64)
-	tok := data["access_token"].(string)
-	if ttype != t.TokenType {
+	ttype, ok := data["token_type"].(string)
+	if !ok {
+		return nil, errors.New("tokeninfo: missing token_type")
+	}
+	tok, ok := data["access_token"].(string)
+	if !ok {
+		return nil, errors.New("tokeninfo: missing access_token")
+	}
+	exp, ok := data["expires_in"].(float64)
+	if !ok {
+		return nil, errors.New("tokeninfo: missing expires_in")
+	}
+	gtype, _ := data["grant_type"].(string)
+	realm, _ := data["realm"].(string)
+	if !tokenTypeMatches(ttype, t.TokenType) {
 		return nil, errors.New("token type mismatch")
 	}
 	if tok != t.AccessToken {
 		return nil, errors.New("mismatch between verify request and answer")
 	}
 
-	scopes := data["scope"].([]interface{})
+	scopes, _ := data["scope"].([]interface{})
 	for _, scope := range scopes {
-		sscope := scope.(string)
+		sscope, ok := scope.(string)
+		if !ok {
+			continue
+		}
 		sval, ok := data[sscope]
 		if ok {
 			tdata[sscope] = sval
 		}
 	}
 
-	return &TokenContainer{
+	tc := &TokenContainer{
 		Token: &oauth2.Token{
 			AccessToken: tok,
 			TokenType:   ttype,
 			Expiry:      time.Now().Add(time.Duration(exp) * time.Second),
 		},
-		Scopes:    tdata,
-		Realm:     realm,
-		GrantType: gtype,
-	}, nil
+		Scopes:       tdata,
+		Realm:        realm,
+		GrantType:    gtype,
+		Audience:     parseAudience(data["aud"]),
+		Confirmation: parseConfirmation(data["cnf"]),
+		JTI:          parseJTI(data["jti"]),
+		RawClaims:    data,
+	}
+	// security relevant claims, aud, cnf, jti, acr, amr and auth_time,
+	// are only taken from the response and never from the unverified
+	// payload of a JWT access token, which may only deny access early,
+	// see DenyList.
+	tc.setAuthentication(data)
+	return tc, nil
+}
+
+// parseJTI returns the jti of tokeninfo.
+func parseJTI(jti interface{}) string {
+	s, _ := jti.(string)
+	return s
+}
+
+// tokenTypeMatches compares the token_type of tokeninfo with the
+// authentication scheme of the request. DPoP tokens may be reported
+// as Bearer by tokeninfo services unaware of DPoP.
+func tokenTypeMatches(info, scheme string) bool {
+	return info == scheme || (strings.EqualFold(scheme, "DPoP") && (strings.EqualFold(info, "DPoP") || info == "Bearer"))
+}
+
+// parseConfirmation returns the cnf of tokeninfo.
+func parseConfirmation(cnf interface{}) map[string]interface{} {
+	m, _ := cnf.(map[string]interface{})
+	return m
+}
+
+// parseAudience returns the aud of tokeninfo, which is a string or an
+// array.
+func parseAudience(aud interface{}) []string {
+	switch v := aud.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		res := make([]string, 0, len(v))
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// HasAudience returns true if the audience of the token contains one
+// of the given values.
+func (t *TokenContainer) HasAudience(audiences ...string) bool {
+	for _, a := range t.Audience {
+		for _, want := range audiences {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func getTokenContainerForToken(o Options, token *oauth2.Token) (*TokenContainer, error) {
-	body, err := requestAuthInfo(o, token)
+func getTokenContainerForToken(ctx context.Context, o Options, token *oauth2.Token) (*TokenContainer, error) {
+	body, err := requestAuthInfo(ctx, o, token)
 	if err != nil {
-		errorf("[Gin-OAuth] RequestAuthInfo failed caused by: %s", err)
-		return nil, err
+		errorw("RequestAuthInfo failed", "flow_id", FlowIDFromContext(ctx), "error", err)
+		return nil, newAuthError(http.StatusUnauthorized, ErrUnavailable, err)
 	}
 	// extract AuthInfo
 	var data map[string]interface{}
 	err = json.Unmarshal(body, &data)
 	if err != nil {
-		errorf("[Gin-OAuth] JSON.Unmarshal failed caused by: %s", err)
-		return nil, err
+		errorw("JSON.Unmarshal of tokeninfo failed", "flow_id", FlowIDFromContext(ctx), "error", err)
+		return nil, newAuthError(http.StatusUnauthorized, ErrUnavailable, err)
 	}
 	if si, ok := data["error_description"]; ok {
 		s, ok := si.(string)
 		if !ok {
 			s = ""
 		}
-		errorf("[Gin-OAuth] RequestAuthInfo returned an error: %s", s)
-		return nil, errors.New(s)
+		// error_description is controlled by the tokeninfo service and may echo the token
+		if token.AccessToken != "" {
+			s = strings.ReplaceAll(s, token.AccessToken, DefaultRedactor.mask)
+		}
+		errorw("RequestAuthInfo returned an error", "flow_id", FlowIDFromContext(ctx), "error", s)
+		return nil, newAuthError(http.StatusUnauthorized, ErrInvalidToken, errors.New(s))
+	}
+	tc, err := ParseTokenContainer(token, data)
+	if err != nil {
+		return nil, newAuthError(http.StatusUnauthorized, ErrInvalidToken, err)
 	}
-	return ParseTokenContainer(token, data)
+	return tc, nil
 }
 
 func GetTokenContainer(token *oauth2.Token) (*TokenContainer, error) {
-	return getTokenContainerForToken(Options{}, token)
+	return getTokenContainerForToken(context.Background(), Options{}, token)
 }
 
-func getTokenContainer(o Options, ctx *gin.Context) (*TokenContainer, bool) {
-	var oauthToken *oauth2.Token
-	var tc *TokenContainer
-	var err error
+type tokenContainerKey struct{}
 
-	if oauthToken, err = extractToken(ctx.Request); err != nil {
-		errorf("[Gin-OAuth] Can not extract oauth2.Token, caused by: %s", err)
-		return nil, false
-	}
-	if !oauthToken.Valid() {
-		infof("[Gin-OAuth] Invalid Token - nil or expired")
-		return nil, false
-	}
-
-	if tc, err = getTokenContainerForToken(o, oauthToken); err != nil {
-		errorf("[Gin-OAuth] Can not extract TokenContainer, caused by: %s", err)
-		return nil, false
-	}
-
-	return tc, true
+// TokenContainerFromContext returns the TokenContainer stored by the
+// Auth middleware for an authorized request. ctx may be the
+// *gin.Context or the context of the *http.Request.
+func TokenContainerFromContext(ctx context.Context) (*TokenContainer, bool) {
+	tc, ok := requestContext(ctx).Value(tokenContainerKey{}).(*TokenContainer)
+	return tc, ok && tc != nil
 }
 
 // Valid validates that the AccessToken within TokenContainer is not
@@ -286,96 +391,145 @@ func AuthChain(endpoint oauth2.Endpoint, accessCheckFunctions ...AccessCheckFunc
 	return AuthChainOptions(Options{Endpoint: endpoint}, accessCheckFunctions...)
 }
 
-func AuthChainOptions(o Options, accessCheckFunctions ...AccessCheckFunction) gin.HandlerFunc {
-	// init
-	AuthInfoURL = o.Endpoint.TokenURL
-	// middleware
-	return func(ctx *gin.Context) {
-		t := time.Now()
-		varianceControl := make(chan bool, 1)
-
-		go func() {
-			tokenContainer, ok := getTokenContainer(o, ctx)
-			if !ok {
-				// set LOCATION header to auth endpoint such that the user can easily get a new access-token
-				ctx.Writer.Header().Set("Location", o.Endpoint.AuthURL)
-				ctx.AbortWithError(http.StatusUnauthorized, errors.New("no token in context"))
-				varianceControl <- false
-				return
-			}
+// authResult is the outcome of the access checks done by the
+// middleware. err is nil if access was granted.
+type authResult struct {
+	tc    *TokenContainer
+	check string
+	err   error
+}
 
-			if !tokenContainer.Valid() {
-				// set LOCATION header to auth endpoint such that the user can easily get a new access-token
-				ctx.Writer.Header().Set("Location", o.Endpoint.AuthURL)
-				ctx.AbortWithError(http.StatusUnauthorized, errors.New("invalid Token"))
-				varianceControl <- false
-				return
-			}
+func (r authResult) uid() string {
+	if r.tc == nil {
+		return ""
+	}
+	return r.tc.UID()
+}
 
-			for i, fn := range accessCheckFunctions {
-				if fn(tokenContainer, ctx) {
-					varianceControl <- true
-					break
-				}
+type checkErrorKey struct{}
+
+// AccessCheck converts a CheckFunction into an AccessCheckFunction for
+// the gin middleware. The gin.Context is passed as context.Context. If
+// the check fails, its error determines the response as it does for
+// Handler.
+func AccessCheck(fn CheckFunction) AccessCheckFunction {
+	return func(tc *TokenContainer, ctx *gin.Context) bool {
+		if err := fn(ctx, tc); err != nil {
+			ctx.Set(checkErrorKey{}, err)
+			return false
+		}
+		return true
+	}
+}
 
-				if len(accessCheckFunctions)-1 == i {
-					ctx.AbortWithError(http.StatusForbidden, errors.New("access to the Resource is forbidden"))
-					varianceControl <- false
-					return
-				}
-			}
-		}()
+type requestValuesKey struct{}
 
-		select {
-		case ok := <-varianceControl:
-			if !ok {
-				infofv2("[Gin-OAuth] %12v %s access not allowed", time.Since(t), ctx.Request.URL.Path)
-				return
-			}
-		case <-time.After(VarianceTimer):
-			ctx.AbortWithError(http.StatusGatewayTimeout, errors.New("authorization check overtime"))
-			infofv2("[Gin-OAuth] %12v %s overtime", time.Since(t), ctx.Request.URL.Path)
-			return
-		}
+type requestValue struct {
+	key, value interface{}
+}
+
+// SetRequestValue stores value under key in ctx and, if access is
+// granted, in the context of the request, where it is visible to
+// context.Context consumers. AccessCheckFunctions use it instead of
+// replacing ctx.Request, because they may still run after the
+// middleware gave up waiting for them.
+func SetRequestValue(ctx *gin.Context, key, value interface{}) {
+	ctx.Set(key, value)
+	values, _ := ctx.Get(requestValuesKey{})
+	pending, _ := values.([]requestValue)
+	ctx.Set(requestValuesKey{}, append(pending[:len(pending):len(pending)], requestValue{key, value}))
+}
 
-		infofv2("[Gin-OAuth] %12v %s access allowed", time.Since(t), ctx.Request.URL.Path)
+// withRequestValues adds the values of SetRequestValue to r.
+func withRequestValues(ctx *gin.Context, r *http.Request) *http.Request {
+	values, _ := ctx.Get(requestValuesKey{})
+	pending, _ := values.([]requestValue)
+	if len(pending) == 0 {
+		return r
+	}
+	c := r.Context()
+	for _, v := range pending {
+		c = context.WithValue(c, v.key, v.value)
 	}
+	return r.WithContext(c)
 }
 
-// RequestLogger is a middleware that logs all the request and prints
-// relevant information.  This can be used for logging all the
-// requests that contain important information and are authorized.
-// The assumption is that the request to log has a content and an Id
-// identifiying who made the request uIdKey string to use as key to
-// get the uid from the context contentKey string to use as key to get
-// the content to be logged from the context.
-//
-// Example:
-//
-//	     var endpoints oauth2.Endpoint = oauth2.Endpoint{
-//		        AuthURL:  "https://token.oauth2.corp.com/access_token",
-//		        TokenURL: "https://oauth2.corp.com/corp/oauth2/tokeninfo",
-//	     }
-//	     var acl []ginoauth2.AccessTuple = []ginoauth2.AccessTuple{{"employee", 1070, "sszuecs"}, {"employee", 1114, "njuettner"}}
-//	     router := gin.Default()
-//	     router.Use(ginoauth2.RequestLogger([]string{"uid"}, "data"))
-func RequestLogger(keys []string, contentKey string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		request := c.Request
-		c.Next()
-		err := c.Errors
-		if request.Method != "GET" && err == nil {
-			if data, ok := c.Get(contentKey); !ok {
-				values := make([]string, 0)
-				for _, key := range keys {
-					val, keyPresent := c.Get(key)
-					if keyPresent {
-						values = append(values, val.(string))
+// ginChecks binds the AccessCheckFunctions to the gin.Context of the
+// current request.
+func ginChecks(ctx *gin.Context, fns []AccessCheckFunction) []namedCheck {
+	checks := make([]namedCheck, len(fns))
+	for i, fn := range fns {
+		fn := fn
+		checks[i] = namedCheck{
+			name: funcName(fn),
+			fn: func(_ context.Context, tc *TokenContainer) error {
+				if fn(tc, ctx) {
+					return nil
+				}
+				if err, ok := ctx.Get(checkErrorKey{}); ok {
+					ctx.Set(checkErrorKey{}, nil)
+					if err, ok := err.(error); ok {
+						return err
 					}
 				}
-				infof("[Gin-OAuth] Request: %+v for %s", data, strings.Join(values, "-"))
-			}
+				return ErrForbidden
+			},
+		}
+	}
+	return checks
+}
+
+// writeAuthError sets the response headers for a request with token,
+// which was rejected with ae.
+func writeAuthError(o Options, h http.Header, token *oauth2.Token, ae *AuthError) {
+	if ae.Status == http.StatusUnauthorized {
+		// set LOCATION header to auth endpoint such that the user can easily get a new access-token
+		h.Set("Location", o.Endpoint.AuthURL)
+	}
+	scheme := o.challengeScheme(token, ae)
+	if c := ae.Challenge(scheme); c != "" && scheme == "Bearer" {
+		h.Set("WWW-Authenticate", c)
+	}
+	o.writeDPoPHeaders(h, scheme, ae)
+}
+
+func AuthChainOptions(o Options, accessCheckFunctions ...AccessCheckFunction) gin.HandlerFunc {
+	// init
+	AuthInfoURL = o.Endpoint.TokenURL
+	// middleware
+	return func(ctx *gin.Context) {
+		t := time.Now()
+		var flowID string
+		ctx.Request, flowID = ensureFlowID(ctx.Request)
+		ctx.Request = withClientCertificate(ctx.Request.WithContext(WithRequestCache(o.withServiceTokenSource(ctx.Request.Context()))))
+		if FlowIDHeader != "" {
+			ctx.Header(FlowIDHeader, flowID)
 		}
+
+		var res authResult
+		token, err := extractToken(ctx.Request)
+		if err != nil {
+			errorw("Can not extract oauth2.Token", "path", ctx.Request.URL.Path, "flow_id", flowID, "error", err)
+			res.err = newAuthError(http.StatusUnauthorized, ErrNoToken, err)
+		} else if ctx.Request, err = o.checkDPoP(ctx.Request, token); err != nil {
+			res.err = err
+		} else {
+			res = authorize(ctx.Request.Context(), o, token, ginChecks(ctx, accessCheckFunctions))
+		}
+		audit(o, ctx.Request, ctx.FullPath(), ctx.ClientIP(), res)
+
+		if res.err != nil {
+			ae := asAuthError(res.err)
+			writeAuthError(o, ctx.Writer.Header(), token, ae)
+			ctx.AbortWithError(ae.Status, ae)
+			debugw("access not allowed", "path", ctx.Request.URL.Path, "flow_id", flowID, "uid", res.uid(), "duration", time.Since(t), "outcome", "denied", "reason", res.err)
+			return
+		}
+
+		o.writeDPoPHeaders(ctx.Writer.Header(), "", nil)
+		ctx.Request = withRequestValues(ctx, ctx.Request)
+		ctx.Request = ctx.Request.WithContext(withInbound(ctx.Request.Context(), res.tc, ctx.Request.Header))
+		debugw("access allowed", "path", ctx.Request.URL.Path, "flow_id", flowID, "uid", res.uid(), "duration", time.Since(t), "outcome", "allowed")
 	}
 }
 
@@ -0,0 +1,155 @@
+package ginoauth2
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// newTokenInfoServer starts a tokeninfo stand-in which answers every
+// token with the given tokeninfo data. access_token and token_type are
+// filled from the request.
+func newTokenInfoServer(t *testing.T, data map[string]interface{}) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok := r.URL.Query().Get("access_token")
+		if tok == "" {
+			tok = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		resp := map[string]interface{}{
+			"access_token": tok,
+			"token_type":   "Bearer",
+			"grant_type":   "password",
+			"expires_in":   float64(3600),
+			"realm":        "/employees",
+			"scope":        []interface{}{"uid"},
+			"uid":          "sszuecs",
+		}
+		for k, v := range data {
+			resp[k] = v
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestRouter(o Options, checks ...AccessCheckFunction) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(AuthChainOptions(o, checks...))
+	router.GET("/private/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	return router
+}
+
+func allowAll(tc *TokenContainer, ctx *gin.Context) bool { return true }
+
+func denyAll(tc *TokenContainer, ctx *gin.Context) bool { return false }
+
+func doRequest(router http.Handler, hdr http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/private/1", nil)
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func bearer(tok string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + tok}}
+}
+
+func TestAuthChainOptions(t *testing.T) {
+	srv := newTokenInfoServer(t, nil)
+	endpoint := oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: srv.URL}
+
+	for _, tt := range []struct {
+		name   string
+		checks []AccessCheckFunction
+		hdr    http.Header
+		status int
+	}{
+		{"granted", []AccessCheckFunction{allowAll}, bearer("token"), http.StatusOK},
+		{"granted by second check", []AccessCheckFunction{denyAll, allowAll}, bearer("token"), http.StatusOK},
+		{"forbidden", []AccessCheckFunction{denyAll}, bearer("token"), http.StatusForbidden},
+		{"no token", []AccessCheckFunction{allowAll}, nil, http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter(Options{Endpoint: endpoint}, tt.checks...)
+			w := doRequest(router, tt.hdr)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusUnauthorized {
+				assert.Equal(t, endpoint.AuthURL, w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestAudiences(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		data     map[string]interface{}
+		token    string
+		audience []string
+		status   int
+	}{
+		{"string", map[string]interface{}{"aud": "orders"}, "token", []string{"orders"}, http.StatusOK},
+		{"array", map[string]interface{}{"aud": []interface{}{"billing", "orders"}}, "token", []string{"billing", "orders"}, http.StatusOK},
+		{"other service", map[string]interface{}{"aud": "billing"}, "token", []string{"billing"}, http.StatusUnauthorized},
+		{"missing", nil, "token", nil, http.StatusUnauthorized},
+		{"unverified jwt claim", nil, jwtWithAudience("orders"), nil, http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTokenInfoServer(t, tt.data)
+			var audience []string
+			check := func(tc *TokenContainer, ctx *gin.Context) bool {
+				audience = tc.Audience
+				return true
+			}
+			router := newTestRouter(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}, Audiences: []string{"orders", "orders-v2"}}, check)
+
+			w := doRequest(router, bearer(tt.token))
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusOK {
+				assert.Equal(t, tt.audience, audience)
+			} else {
+				assert.Equal(t, `Bearer error="invalid_token", error_description="token audience not accepted"`, w.Header().Get("WWW-Authenticate"))
+			}
+
+			// without Audiences the audience is not validated
+			w = doRequest(newTestRouter(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, check), bearer(tt.token))
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.audience, audience)
+		})
+	}
+}
+
+func TestParseTokenContainerIgnoresUnverifiedClaims(t *testing.T) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"aud": "orders", "jti": "webhook-1", "cnf": map[string]interface{}{"jkt": "key"}, "acr": "mfa",
+	})
+	tok := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+	data := map[string]interface{}{"access_token": tok, "token_type": "Bearer", "expires_in": float64(3600)}
+
+	tc, err := ParseTokenContainer(&oauth2.Token{AccessToken: tok, TokenType: "Bearer"}, data)
+	assert.NoError(t, err)
+	assert.Empty(t, tc.Audience)
+	assert.Empty(t, tc.JTI)
+	assert.Empty(t, tc.Confirmation)
+	assert.Empty(t, tc.ACR)
+}
+
+func jwtWithAudience(aud string) string {
+	payload, _ := json.Marshal(map[string]interface{}{"aud": aud})
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
@@ -15,7 +15,7 @@ import (
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
+	ginoauth2 "github.com/zalando/gin-oauth2"
 
 	"github.com/google/go-github/github"
 	"golang.org/x/oauth2"
@@ -34,24 +34,26 @@ var (
 	store sessions.Store
 )
 
-func randToken() string {
+func randToken() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
-		glog.Fatalf("[Gin-OAuth] Failed to read rand: %v\n", err)
+		return "", fmt.Errorf("failed to read rand: %w", err)
 	}
-	return base64.StdEncoding.EncodeToString(b)
+	return base64.StdEncoding.EncodeToString(b), nil
 }
 
-func Setup(redirectURL, credFile string, scopes []string, secret []byte) {
+// Setup reads the client credentials from credFile and configures the
+// authorization. It returns an error if credFile can not be read.
+func Setup(redirectURL, credFile string, scopes []string, secret []byte) error {
 	store = cookie.NewStore(secret)
 	var c Credentials
 	file, err := os.ReadFile(credFile)
 	if err != nil {
-		glog.Fatalf("[Gin-OAuth] File error: %v\n", err)
+		return fmt.Errorf("failed to read client credentials: %w", err)
 	}
 	err = json.Unmarshal(file, &c)
 	if err != nil {
-		glog.Fatalf("[Gin-OAuth] Failed to unmarshal client credentials: %v\n", err)
+		return fmt.Errorf("failed to unmarshal client credentials %s: %w", credFile, err)
 	}
 	conf = &oauth2.Config{
 		ClientID:     c.ClientID,
@@ -60,6 +62,7 @@ func Setup(redirectURL, credFile string, scopes []string, secret []byte) {
 		Scopes:       scopes,
 		Endpoint:     oauth2gh.Endpoint,
 	}
+	return nil
 }
 
 func Session(name string) gin.HandlerFunc {
@@ -67,7 +70,11 @@ func Session(name string) gin.HandlerFunc {
 }
 
 func LoginHandler(ctx *gin.Context) {
-	state = randToken()
+	var err error
+	if state, err = randToken(); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 	session := sessions.Default(ctx)
 	session.Set("state", state)
 	session.Save()
@@ -116,7 +123,7 @@ func Auth() gin.HandlerFunc {
 		stdctx := context.Background()
 		tok, err := conf.Exchange(stdctx, ctx.Query("code"))
 		if err != nil {
-			ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("failed to do exchange: %w", err))
+			ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("failed to do exchange: %w", ginoauth2.RedactError(err)))
 			return
 		}
 		client := github.NewClient(conf.Client(stdctx, tok))
@@ -138,7 +145,7 @@ func Auth() gin.HandlerFunc {
 		// populate cookie
 		session.Set("ginoauthgh", authUser)
 		if err := session.Save(); err != nil {
-			glog.Errorf("Failed to save session: %v", err)
+			ginoauth2.Log().Errorw("Failed to save session", "uid", authUser.Login, "error", err)
 		}
 	}
 }
@@ -18,7 +18,7 @@ import (
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
+	ginoauth2 "github.com/zalando/gin-oauth2"
 	goauth "google.golang.org/api/oauth2/v2"
 	"google.golang.org/api/option"
 
@@ -48,25 +48,26 @@ func init() {
 
 var loginURL string
 
-func randToken() string {
+func randToken() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
-		glog.Fatalf("[Gin-OAuth] Failed to read rand: %v", err)
+		return "", fmt.Errorf("failed to read rand: %w", err)
 	}
-	return base64.StdEncoding.EncodeToString(b)
+	return base64.StdEncoding.EncodeToString(b), nil
 }
 
-// Setup the authorization path
-func Setup(redirectURL, credFile string, scopes []string, secret []byte) {
+// Setup the authorization path. It returns an error if the client
+// credentials can not be read from credFile.
+func Setup(redirectURL, credFile string, scopes []string, secret []byte) error {
 	store = cookie.NewStore(secret)
 
 	var c Credentials
 	file, err := os.ReadFile(credFile)
 	if err != nil {
-		glog.Fatalf("[Gin-OAuth] File error: %v", err)
+		return fmt.Errorf("failed to read client credentials: %w", err)
 	}
 	if err := json.Unmarshal(file, &c); err != nil {
-		glog.Fatalf("[Gin-OAuth] Failed to unmarshal client credentials: %v", err)
+		return fmt.Errorf("failed to unmarshal client credentials %s: %w", credFile, err)
 	}
 
 	conf = &oauth2.Config{
@@ -76,6 +77,7 @@ func Setup(redirectURL, credFile string, scopes []string, secret []byte) {
 		Scopes:       scopes,
 		Endpoint:     google.Endpoint,
 	}
+	return nil
 }
 
 // SetupFromString accepts string values for ouath2 Configs
@@ -96,7 +98,11 @@ func Session(name string) gin.HandlerFunc {
 }
 
 func LoginHandler(ctx *gin.Context) {
-	stateValue := randToken()
+	stateValue, err := randToken()
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 	session := sessions.Default(ctx)
 	session.Set(stateKey, stateValue)
 	session.Save()
@@ -174,20 +180,20 @@ func Auth() gin.HandlerFunc {
 
 		tok, err := conf.Exchange(context.TODO(), ctx.Query("code"))
 		if err != nil {
-			ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("failed to exchange code for oauth token: %w", err))
+			ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("failed to exchange code for oauth token: %w", ginoauth2.RedactError(err)))
 			return
 		}
 
 		oAuth2Service, err := goauth.NewService(ctx, option.WithTokenSource(conf.TokenSource(ctx, tok)))
 		if err != nil {
-			glog.Errorf("[Gin-OAuth] Failed to create oauth service: %v", err)
+			ginoauth2.Log().Errorw("Failed to create oauth service", "path", ctx.Request.URL.Path, "error", err)
 			ctx.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to create oauth service: %w", err))
 			return
 		}
 
 		userInfo, err := oAuth2Service.Userinfo.Get().Do()
 		if err != nil {
-			glog.Errorf("[Gin-OAuth] Failed to get userinfo for user: %v", err)
+			ginoauth2.Log().Errorw("Failed to get userinfo for user", "path", ctx.Request.URL.Path, "error", err)
 			ctx.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to get userinfo for user: %w", err))
 			return
 		}
@@ -196,7 +202,7 @@ func Auth() gin.HandlerFunc {
 
 		session.Set(sessionID, userInfo)
 		if err := session.Save(); err != nil {
-			glog.Errorf("[Gin-OAuth] Failed to save session: %v", err)
+			ginoauth2.Log().Errorw("Failed to save session", "uid", userInfo.Email, "error", err)
 			ctx.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to save session: %v", err))
 			return
 		}
@@ -54,3 +54,16 @@ func TestWithLoginURL(t *testing.T) {
 		})
 	}
 }
+
+func TestSetup(t *testing.T) {
+	t.Run("should return an error for a missing credentials file", func(t *testing.T) {
+		err := Setup("http://fake.fake", "does-not-exist.json", []string{}, []byte("secret"))
+		assert.ErrorContains(t, err, "failed to read client credentials")
+	})
+	t.Run("should assign config from the credentials file", func(t *testing.T) {
+		conf = nil
+		err := Setup("http://fake.fake", "../example/google/test-clientid.google.json", []string{}, []byte("secret"))
+		assert.NoError(t, err)
+		assert.NotNil(t, conf)
+	})
+}
@@ -0,0 +1,145 @@
+// Package grpcauth provides gRPC server interceptors, which validate
+// OAuth2 bearer tokens in the same way as the gin and net/http
+// middlewares of ginoauth2.
+//
+// Example:
+//
+//	o := ginoauth2.Options{Endpoint: zalando.OAuth2Endpoint}
+//	srv := grpc.NewServer(
+//		grpc.UnaryInterceptor(grpcauth.UnaryServerInterceptor(o, ginoauth2.RequireScopes("uid"))),
+//		grpc.StreamInterceptor(grpcauth.StreamServerInterceptor(o, ginoauth2.RequireScopes("uid"))),
+//	)
+package grpcauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	ginoauth2 "github.com/zalando/gin-oauth2"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// extractToken reads the token from the "authorization" metadata.
+func extractToken(md metadata.MD) (*oauth2.Token, error) {
+	vals := md.Get("authorization")
+	if len(vals) == 0 || vals[0] == "" {
+		return nil, errors.New("no authorization metadata")
+	}
+	typ, token, ok := strings.Cut(vals[0], " ")
+	if !ok || token == "" {
+		return nil, errors.New("invalid authorization metadata")
+	}
+	return &oauth2.Token{AccessToken: token, TokenType: typ}, nil
+}
+
+// flowID returns the flow ID of the call from the metadata or a new
+// one, if it is missing or invalid.
+func flowID(md metadata.MD) string {
+	if ginoauth2.FlowIDHeader != "" {
+		if vals := md.Get(ginoauth2.FlowIDHeader); len(vals) > 0 && ginoauth2.ValidFlowID(vals[0]) {
+			return vals[0]
+		}
+	}
+	return ginoauth2.NewFlowID()
+}
+
+// toStatus maps errors of ginoauth2.Verify to gRPC status codes. The
+// messages are fixed, such that details of the tokeninfo response or
+// the checks are not sent to the client.
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, ginoauth2.ErrUnavailable), errors.Is(err, ginoauth2.ErrTimeout):
+		return status.Error(codes.Unavailable, "authorization unavailable")
+	case errors.Is(err, ginoauth2.ErrNoToken), errors.Is(err, ginoauth2.ErrInvalidToken):
+		return status.Error(codes.Unauthenticated, "invalid token")
+	}
+	var ae *ginoauth2.AuthError
+	if errors.As(err, &ae) && ae.Status == http.StatusUnauthorized {
+		return status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return status.Error(codes.PermissionDenied, "permission denied")
+}
+
+// clientIP returns the IP address of the peer of the call.
+func clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+// authenticate validates the token of the call and returns a context
+// carrying the TokenContainer and the flow ID. The decision is
+// recorded with ginoauth2.Audit; gRPC calls are audited with method
+// POST and the full method name as route.
+func authenticate(ctx context.Context, method string, o ginoauth2.Options, checks []ginoauth2.CheckFunction) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = ginoauth2.WithRequestCache(ginoauth2.WithFlowID(ctx, flowID(md)))
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+			ctx = ginoauth2.WithClientCertificate(ctx, info.State.PeerCertificates[0])
+		}
+	}
+
+	token, err := extractToken(md)
+	if err != nil {
+		ginoauth2.Log().Errorw("Can not extract oauth2.Token", "method", method, "flow_id", ginoauth2.FlowIDFromContext(ctx), "error", err)
+		ginoauth2.Audit(ctx, o, http.MethodPost, method, clientIP(ctx), nil, err)
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	tc, err := ginoauth2.Verify(ctx, o, token, checks...)
+	ginoauth2.Audit(ctx, o, http.MethodPost, method, clientIP(ctx), tc, err)
+	if err != nil {
+		ginoauth2.Log().Debugw("access not allowed", "method", method, "flow_id", ginoauth2.FlowIDFromContext(ctx), "outcome", "denied", "reason", ginoauth2.RedactError(err))
+		return nil, toStatus(err)
+	}
+	return ginoauth2.WithTokenContainer(ctx, tc), nil
+}
+
+// UnaryServerInterceptor returns an interceptor that rejects unary
+// calls without a token granted by one of the checks. Handlers get
+// the TokenContainer with ginoauth2.TokenContainerFromContext.
+func UnaryServerInterceptor(o ginoauth2.Options, checks ...ginoauth2.CheckFunction) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, info.FullMethod, o, checks)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// StreamServerInterceptor returns an interceptor that rejects
+// streaming calls without a token granted by one of the checks.
+func StreamServerInterceptor(o ginoauth2.Options, checks ...ginoauth2.CheckFunction) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), info.FullMethod, o, checks)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
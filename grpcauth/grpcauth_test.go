@@ -0,0 +1,211 @@
+package grpcauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ginoauth2 "github.com/zalando/gin-oauth2"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// tokenInfo is a local tokeninfo stand-in which accepts the token
+// "valid" for uid sszuecs and rejects all others.
+func tokenInfo(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok := r.URL.Query().Get("access_token")
+		if tok != "valid" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "invalid_token", "error_description": "Access Token not valid"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": tok, "token_type": "Bearer", "grant_type": "password", "expires_in": float64(3600),
+			"realm": "/employees", "scope": []interface{}{"uid"}, "uid": "sszuecs",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+type recordingHealthServer struct {
+	*health.Server
+	uid string
+}
+
+func (h *recordingHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if tc, ok := ginoauth2.TokenContainerFromContext(ctx); ok {
+		h.uid, _ = tc.Scopes["uid"].(string)
+	}
+	return h.Server.Check(ctx, req)
+}
+
+func newClient(t *testing.T, o ginoauth2.Options, checks ...ginoauth2.CheckFunction) (healthpb.HealthClient, *recordingHealthServer) {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(o, checks...)),
+		grpc.StreamInterceptor(StreamServerInterceptor(o, checks...)),
+	)
+	hs := &recordingHealthServer{Server: health.NewServer()}
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn), hs
+}
+
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	o := ginoauth2.Options{Endpoint: oauth2.Endpoint{TokenURL: tokenInfo(t).URL}}
+	deny := func(ctx context.Context, tc *ginoauth2.TokenContainer) error { return errors.New("denied") }
+
+	for _, tt := range []struct {
+		name   string
+		ctx    context.Context
+		o      ginoauth2.Options
+		checks []ginoauth2.CheckFunction
+		code   codes.Code
+	}{
+		{"granted", withToken("valid"), o, []ginoauth2.CheckFunction{ginoauth2.RequireScopes("uid")}, codes.OK},
+		{"no token", context.Background(), o, []ginoauth2.CheckFunction{ginoauth2.RequireScopes("uid")}, codes.Unauthenticated},
+		{"invalid token", withToken("invalid"), o, []ginoauth2.CheckFunction{ginoauth2.RequireScopes("uid")}, codes.Unauthenticated},
+		{"forbidden", withToken("valid"), o, []ginoauth2.CheckFunction{deny}, codes.PermissionDenied},
+		{"tokeninfo unavailable", withToken("valid"), ginoauth2.Options{Endpoint: oauth2.Endpoint{TokenURL: "http://127.0.0.1:1"}},
+			[]ginoauth2.CheckFunction{ginoauth2.RequireScopes("uid")}, codes.Unavailable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, hs := newClient(t, tt.o, tt.checks...)
+
+			_, err := client.Check(tt.ctx, &healthpb.HealthCheckRequest{})
+
+			assert.Equal(t, tt.code, status.Code(err), err)
+			if tt.code == codes.OK {
+				assert.Equal(t, "sszuecs", hs.uid)
+			}
+		})
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	o := ginoauth2.Options{Endpoint: oauth2.Endpoint{TokenURL: tokenInfo(t).URL}}
+	client, _ := newClient(t, o, ginoauth2.RequireScopes("uid"))
+
+	stream, err := client.Watch(withToken("valid"), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	stream, err = client.Watch(withToken("invalid"), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Equal(t, "invalid token", status.Convert(err).Message())
+}
+
+type memoryAuditSink struct {
+	mu     sync.Mutex
+	events []ginoauth2.AuditEvent
+}
+
+func (m *memoryAuditSink) Audit(e ginoauth2.AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, e)
+	return nil
+}
+
+func (m *memoryAuditSink) last() ginoauth2.AuditEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.events[len(m.events)-1]
+}
+
+func TestStatusMessagesAndAudit(t *testing.T) {
+	sink := &memoryAuditSink{}
+	o := ginoauth2.Options{Endpoint: oauth2.Endpoint{TokenURL: tokenInfo(t).URL}, AuditSink: sink}
+	deny := func(ctx context.Context, tc *ginoauth2.TokenContainer) error {
+		return errors.New("uid sszuecs not in team")
+	}
+	const method = "/grpc.health.v1.Health/Check"
+
+	for _, tt := range []struct {
+		name     string
+		ctx      context.Context
+		check    ginoauth2.CheckFunction
+		message  string
+		decision ginoauth2.Decision
+		uid      string
+	}{
+		{"granted", withToken("valid"), ginoauth2.RequireScopes("uid"), "", ginoauth2.DecisionGrant, "sszuecs"},
+		{"no token", context.Background(), ginoauth2.RequireScopes("uid"), "invalid token", ginoauth2.DecisionDeny, ""},
+		{"invalid token", withToken("invalid"), ginoauth2.RequireScopes("uid"), "invalid token", ginoauth2.DecisionDeny, ""},
+		{"forbidden", withToken("valid"), deny, "permission denied", ginoauth2.DecisionDeny, "sszuecs"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newClient(t, o, tt.check)
+
+			_, err := client.Check(tt.ctx, &healthpb.HealthCheckRequest{})
+
+			assert.Equal(t, tt.message, status.Convert(err).Message())
+			e := sink.last()
+			assert.Equal(t, tt.decision, e.Decision)
+			assert.Equal(t, tt.uid, e.UID)
+			assert.Equal(t, http.MethodPost, e.Method)
+			assert.Equal(t, method, e.Route)
+			assert.NotEmpty(t, e.FlowID)
+			if tt.decision == ginoauth2.DecisionDeny {
+				assert.NotEmpty(t, e.Reason)
+			}
+		})
+	}
+}
+
+func TestFlowID(t *testing.T) {
+	sink := &memoryAuditSink{}
+	o := ginoauth2.Options{Endpoint: oauth2.Endpoint{TokenURL: tokenInfo(t).URL}, AuditSink: sink}
+	client, _ := newClient(t, o, ginoauth2.RequireScopes("uid"))
+
+	for _, tt := range []struct {
+		name  string
+		id    string
+		valid bool
+	}{
+		{"valid", "JAh6xdAxMQiOXQp1", true},
+		{"too long", strings.Repeat("a", 65), false},
+		{"invalid characters", "<script>", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.AppendToOutgoingContext(withToken("valid"), "x-flow-id", tt.id)
+			_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+			require.NoError(t, err)
+
+			id := sink.last().FlowID
+			assert.True(t, ginoauth2.ValidFlowID(id), id)
+			assert.Equal(t, tt.valid, id == tt.id)
+		})
+	}
+}
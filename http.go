@@ -0,0 +1,84 @@
+package ginoauth2
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Handler returns a net/http middleware that does the same as
+// AuthChainOptions for gin: it validates the token of the request
+// and grants access if one of the checks returns nil. The
+// TokenContainer is stored in the request context, see
+// TokenContainerFromContext.
+//
+// Example:
+//
+//	mux := http.NewServeMux()
+//	mux.Handle("/api/private", privateHandler)
+//	auth := ginoauth2.Handler(ginoauth2.Options{Endpoint: zalando.OAuth2Endpoint}, ginoauth2.RequireScopes("uid"))
+//	http.ListenAndServe(":8081", auth(mux))
+func Handler(o Options, checks ...CheckFunction) func(http.Handler) http.Handler {
+	named := make([]namedCheck, len(checks))
+	for i, fn := range checks {
+		named[i] = namedCheck{name: funcName(fn), fn: fn}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := time.Now()
+			r, flowID := ensureFlowID(r)
+			r = withClientCertificate(r.WithContext(WithRequestCache(o.withServiceTokenSource(r.Context()))))
+			if FlowIDHeader != "" {
+				w.Header().Set(FlowIDHeader, flowID)
+			}
+
+			var res authResult
+			token, err := extractToken(r)
+			if err != nil {
+				errorw("Can not extract oauth2.Token", "path", r.URL.Path, "flow_id", flowID, "error", err)
+				res.err = newAuthError(http.StatusUnauthorized, ErrNoToken, err)
+			} else if r, err = o.checkDPoP(r, token); err != nil {
+				res.err = err
+			} else {
+				res = authorize(WithRequest(r.Context(), r), o, token, named)
+			}
+			audit(o, r, r.Pattern, clientIP(r), res)
+
+			if res.err != nil {
+				ae := asAuthError(res.err)
+				writeAuthError(o, w.Header(), token, ae)
+				http.Error(w, http.StatusText(ae.Status), ae.Status)
+				debugw("access not allowed", "path", r.URL.Path, "flow_id", flowID, "uid", res.uid(), "duration", time.Since(t), "outcome", "denied", "reason", res.err)
+				return
+			}
+
+			o.writeDPoPHeaders(w.Header(), "", nil)
+			debugw("access allowed", "path", r.URL.Path, "flow_id", flowID, "uid", res.uid(), "duration", time.Since(t), "outcome", "allowed")
+			next.ServeHTTP(w, r.WithContext(withInbound(r.Context(), res.tc, r.Header)))
+		})
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RequireScopes returns a CheckFunction that grants access if the
+// token has all of the given scopes.
+func RequireScopes(scopes ...string) CheckFunction {
+	return func(_ context.Context, tc *TokenContainer) error {
+		for _, s := range scopes {
+			if !tc.HasScope(s) {
+				return newAuthError(http.StatusForbidden, ErrForbidden, fmt.Errorf("missing scope %s", s))
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,107 @@
+package ginoauth2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func allowAllContext(ctx context.Context, tc *TokenContainer) error { return nil }
+
+func denyAllContext(ctx context.Context, tc *TokenContainer) error { return errors.New("denied") }
+
+func requireInvalidToken(ctx context.Context, tc *TokenContainer) error {
+	return &AuthError{Status: http.StatusUnauthorized, Code: "invalid_token", Description: "wrong audience", Err: ErrInvalidToken}
+}
+
+// TestHandlerMatchesGin runs the same requests against the net/http
+// and the gin middleware and expects identical responses.
+func TestHandlerMatchesGin(t *testing.T) {
+	srv := newTokenInfoServer(t, nil)
+	o := Options{Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: srv.URL}}
+
+	for _, tt := range []struct {
+		name   string
+		checks []CheckFunction
+		hdr    http.Header
+		status int
+		auth   string
+	}{
+		{"granted", []CheckFunction{allowAllContext}, bearer("token"), http.StatusOK, ""},
+		{"granted by second check", []CheckFunction{denyAllContext, allowAllContext}, bearer("token"), http.StatusOK, ""},
+		{"forbidden", []CheckFunction{denyAllContext}, bearer("token"), http.StatusForbidden, ""},
+		{"required scope", []CheckFunction{RequireScopes("uid")}, bearer("token"), http.StatusOK, ""},
+		{"missing scope", []CheckFunction{RequireScopes("uid", "admin")}, bearer("token"), http.StatusForbidden, ""},
+		{"no token", []CheckFunction{allowAllContext}, nil, http.StatusUnauthorized, ""},
+		{"invalid authorization header", []CheckFunction{allowAllContext}, http.Header{"Authorization": {"Bearer"}}, http.StatusUnauthorized, ""},
+		{"challenge from check", []CheckFunction{denyAllContext, requireInvalidToken}, bearer("token"), http.StatusUnauthorized,
+			`Bearer error="invalid_token", error_description="wrong audience"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var tc *TokenContainer
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tc, _ = TokenContainerFromContext(r.Context())
+				w.Write([]byte("ok"))
+			})
+			handler := Handler(o, tt.checks...)(next)
+
+			fns := make([]AccessCheckFunction, len(tt.checks))
+			for i, c := range tt.checks {
+				fns[i] = AccessCheck(c)
+			}
+			router := newTestRouter(o, fns...)
+
+			hw := doRequest(handler, tt.hdr)
+			gw := doRequest(router, tt.hdr)
+
+			assert.Equal(t, tt.status, hw.Code)
+			assert.Equal(t, tt.status, gw.Code)
+			for _, h := range []string{"Location", "WWW-Authenticate"} {
+				assert.Equal(t, gw.Header().Get(h), hw.Header().Get(h), h)
+			}
+			assert.Equal(t, tt.auth, hw.Header().Get("WWW-Authenticate"))
+			if tt.status == http.StatusOK {
+				assert.NotNil(t, tc)
+				assert.Equal(t, "sszuecs", tc.Scopes["uid"])
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	srv := newTokenInfoServer(t, nil)
+	o := Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}
+	token := &oauth2.Token{AccessToken: "token", TokenType: "Bearer"}
+
+	tc, err := Verify(context.Background(), o, token, allowAllContext)
+	assert.NoError(t, err)
+	assert.Equal(t, "/employees", tc.Realm)
+
+	_, err = Verify(context.Background(), o, token, denyAllContext)
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	_, err = Verify(context.Background(), Options{Endpoint: oauth2.Endpoint{TokenURL: "http://127.0.0.1:1"}}, token, allowAllContext)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	var ae *AuthError
+	assert.ErrorAs(t, err, &ae)
+	assert.Equal(t, http.StatusUnauthorized, ae.Status)
+}
+
+func TestHandlerStoresTokenContainerForGin(t *testing.T) {
+	srv := newTokenInfoServer(t, nil)
+	router := newTestRouter(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, allowAll)
+	var found bool
+	router.GET("/tc", func(c *gin.Context) {
+		_, found = TokenContainerFromContext(c)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/tc", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, found)
+}
@@ -0,0 +1,166 @@
+package ginoauth2
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// claim returns the claim name, from Scopes or RawClaims. Scopes come
+// first, as they hold the claims mapped by a ClaimMapping, p.e. the
+// uid, which may differ from the raw claim of the same name.
+func (t *TokenContainer) claim(name string) (interface{}, bool) {
+	if t == nil {
+		return nil, false
+	}
+	if v, ok := t.Scopes[name]; ok && v != nil {
+		return v, true
+	}
+	v, ok := t.RawClaims[name]
+	return v, ok && v != nil
+}
+
+// stringClaim returns the first of names which is a non-empty string.
+func (t *TokenContainer) stringClaim(names ...string) string {
+	for _, name := range names {
+		if s, ok := Claim[string](t, name); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// UID returns the uid of the token, p.e. the user name of an employee
+// or the name of a service, or "" if the token has none. Like Claim it
+// falls back to RawClaims if the uid is not in Scopes. The checks of
+// package zalando only use the uid scope.
+func (t *TokenContainer) UID() string {
+	return t.stringClaim("uid")
+}
+
+// Subject returns the sub claim of the token, falling back to UID.
+func (t *TokenContainer) Subject() string {
+	return t.stringClaim("sub", "uid")
+}
+
+// ClientID returns the client the token was issued to, from the
+// client_id or azp claim.
+func (t *TokenContainer) ClientID() string {
+	return t.stringClaim("client_id", "azp")
+}
+
+// Issuer returns the iss claim of the token or the Name of the Issuer
+// which validated it.
+func (t *TokenContainer) Issuer() string {
+	if t == nil {
+		return ""
+	}
+	return t.issuer
+}
+
+// ExpiresAt returns the expiry of the token, the zero time if it has
+// none.
+func (t *TokenContainer) ExpiresAt() time.Time {
+	if t == nil || t.Token == nil {
+		return time.Time{}
+	}
+	return t.Token.Expiry
+}
+
+// ScopeList returns the scopes granted to the token. It uses the scope
+// claim, a list or a space separated string, and falls back to the
+// sorted keys of Scopes.
+func (t *TokenContainer) ScopeList() []string {
+	if t == nil {
+		return nil
+	}
+	if v, ok := t.RawClaims["scope"]; ok {
+		switch s := v.(type) {
+		case string:
+			return strings.Fields(s)
+		case []interface{}:
+			scopes := make([]string, 0, len(s))
+			for _, e := range s {
+				if e, ok := e.(string); ok {
+					scopes = append(scopes, e)
+				}
+			}
+			return scopes
+		}
+	}
+	scopes := make([]string, 0, len(t.Scopes))
+	for s := range t.Scopes {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// HasScope reports whether the token was granted scope.
+func (t *TokenContainer) HasScope(scope string) bool {
+	if t == nil {
+		return false
+	}
+	if _, ok := t.Scopes[scope]; ok {
+		return true
+	}
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Claim returns the claim name of tc converted to T. It looks up
+// Scopes first and RawClaims second, and reports false if the claim is
+// missing or has a different type. Whole JSON numbers are converted to
+// int and int64, lists to []string if all elements are strings.
+//
+// Example:
+//
+//	level, ok := ginoauth2.Claim[int](tc, "level")
+func Claim[T any](tc *TokenContainer, name string) (T, bool) {
+	var zero T
+	v, ok := tc.claim(name)
+	if !ok {
+		return zero, false
+	}
+	if t, ok := v.(T); ok {
+		return t, true
+	}
+	var converted interface{}
+	switch any(zero).(type) {
+	case int:
+		if f, ok := integral(v); ok && f >= math.MinInt && f < math.MaxInt {
+			converted = int(f)
+		}
+	case int64:
+		if f, ok := integral(v); ok && f >= math.MinInt64 && f < math.MaxInt64 {
+			converted = int64(f)
+		}
+	case []string:
+		if l, ok := v.([]interface{}); ok {
+			s := make([]string, 0, len(l))
+			for _, e := range l {
+				e, ok := e.(string)
+				if !ok {
+					return zero, false
+				}
+				s = append(s, e)
+			}
+			converted = s
+		}
+	}
+	if t, ok := converted.(T); ok {
+		return t, true
+	}
+	return zero, false
+}
+
+// integral returns v as float64 if it is a whole JSON number.
+func integral(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok && f == math.Trunc(f)
+}
@@ -0,0 +1,118 @@
+package ginoauth2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestIdentityAccessors(t *testing.T) {
+	exp := time.Now().Add(time.Hour)
+	tc := &TokenContainer{
+		Token:  &oauth2.Token{AccessToken: "token", Expiry: exp},
+		Scopes: map[string]interface{}{"uid": "sszuecs", "cn": true},
+		RawClaims: map[string]interface{}{
+			"scope":  "uid cn read",
+			"sub":    "0b8a1c",
+			"azp":    "orders",
+			"level":  float64(3),
+			"ratio":  1.5,
+			"groups": []interface{}{"a", "b"},
+			"mixed":  []interface{}{"a", float64(1)},
+		},
+		issuer: "https://identity.example.org",
+	}
+
+	assert.Equal(t, "sszuecs", tc.UID())
+	assert.Equal(t, "0b8a1c", tc.Subject())
+	assert.Equal(t, "orders", tc.ClientID())
+	assert.Equal(t, "https://identity.example.org", tc.Issuer())
+	assert.Equal(t, exp, tc.ExpiresAt())
+	assert.Equal(t, []string{"uid", "cn", "read"}, tc.ScopeList())
+	assert.True(t, tc.HasScope("read"))
+	assert.True(t, tc.HasScope("cn"))
+	assert.False(t, tc.HasScope("write"))
+
+	level, ok := Claim[int](tc, "level")
+	assert.True(t, ok)
+	assert.Equal(t, 3, level)
+	_, ok = Claim[int](tc, "ratio")
+	assert.False(t, ok)
+	ratio, ok := Claim[float64](tc, "ratio")
+	assert.True(t, ok)
+	assert.Equal(t, 1.5, ratio)
+	groups, ok := Claim[[]string](tc, "groups")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a", "b"}, groups)
+	_, ok = Claim[[]string](tc, "mixed")
+	assert.False(t, ok)
+	_, ok = Claim[string](tc, "level")
+	assert.False(t, ok)
+	cn, ok := Claim[bool](tc, "cn")
+	assert.True(t, ok)
+	assert.True(t, cn)
+}
+
+func TestClaimPrefersMappedClaims(t *testing.T) {
+	// ClaimMapping{UID: "username"} maps username to uid, the raw uid
+	// claim of the issuer means something else
+	tc := &TokenContainer{
+		Scopes:    map[string]interface{}{"uid": "sszuecs"},
+		RawClaims: map[string]interface{}{"uid": "8e2a0f", "username": "sszuecs"},
+	}
+	assert.Equal(t, "sszuecs", tc.UID())
+	uid, ok := Claim[string](tc, "uid")
+	assert.True(t, ok)
+	assert.Equal(t, "sszuecs", uid)
+	username, ok := Claim[string](tc, "username")
+	assert.True(t, ok)
+	assert.Equal(t, "sszuecs", username)
+}
+
+func TestIdentityAccessorsMissingClaims(t *testing.T) {
+	for _, tc := range []*TokenContainer{
+		nil,
+		{},
+		{Scopes: map[string]interface{}{"uid": 42, "sub": nil}, RawClaims: map[string]interface{}{"scope": 7}},
+	} {
+		assert.NotPanics(t, func() {
+			assert.Equal(t, "", tc.UID())
+			assert.Equal(t, "", tc.Subject())
+			assert.Equal(t, "", tc.ClientID())
+			assert.Equal(t, "", tc.Issuer())
+			assert.True(t, tc.ExpiresAt().IsZero())
+			assert.False(t, tc.HasScope("read"))
+			_, ok := Claim[string](tc, "uid")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestParseTokenContainerInvalidTokenInfo(t *testing.T) {
+	token := &oauth2.Token{AccessToken: "token", TokenType: "Bearer"}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"access_token": "token",
+			"token_type":   "Bearer",
+			"expires_in":   float64(3600),
+			"scope":        []interface{}{"uid", 42},
+			"uid":          "sszuecs",
+		}
+	}
+
+	tc, err := ParseTokenContainer(token, valid())
+	assert.NoError(t, err)
+	assert.Equal(t, "sszuecs", tc.UID())
+	assert.Equal(t, "", tc.Realm)
+
+	for _, field := range []string{"access_token", "token_type", "expires_in"} {
+		data := valid()
+		data[field] = true
+		assert.NotPanics(t, func() {
+			_, err := ParseTokenContainer(token, data)
+			assert.Error(t, err, field)
+		})
+	}
+}
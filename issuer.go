@@ -0,0 +1,444 @@
+package ginoauth2
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Validator validates an access token and returns its TokenContainer.
+// Errors should be an *AuthError classified as ErrInvalidToken or
+// ErrUnavailable.
+type Validator interface {
+	Validate(ctx context.Context, token *oauth2.Token) (*TokenContainer, error)
+}
+
+// Issuer is a trusted token issuer, see Options.Issuers.
+type Issuer struct {
+	// Name is the iss claim of the tokens of this issuer. JWT access
+	// tokens are routed to the Issuer with the matching Name.
+	Name string
+	// Validator validates the tokens of this issuer.
+	Validator Validator
+	// Opaque tries Validator for tokens without iss claim, p.e.
+	// opaque tokens of a legacy tokeninfo service. Opaque issuers are
+	// tried in the order of Options.Issuers.
+	Opaque bool
+}
+
+// ErrUntrustedIssuer is returned if the iss claim of a token does not
+// match any of Options.Issuers.
+var ErrUntrustedIssuer = errors.New("untrusted token issuer")
+
+func invalidToken(description string, cause error) *AuthError {
+	ae := newAuthError(http.StatusUnauthorized, ErrInvalidToken, cause)
+	ae.Code = "invalid_token"
+	ae.Description = description
+	return ae
+}
+
+// validateToken returns the TokenContainer of token using Issuers or,
+// if none are configured, the tokeninfo service of o.Endpoint.
+func (o Options) validateToken(ctx context.Context, token *oauth2.Token) (*TokenContainer, error) {
+	if len(o.Issuers) == 0 {
+		return getTokenContainerForToken(ctx, o, token)
+	}
+
+	if iss, ok := unverifiedClaims(token.AccessToken)["iss"].(string); ok {
+		for _, is := range o.Issuers {
+			if is.Name == iss {
+				return is.validate(ctx, token)
+			}
+		}
+		return nil, invalidToken("untrusted token issuer", fmt.Errorf("%w %q", ErrUntrustedIssuer, iss))
+	}
+
+	var err error
+	for _, is := range o.Issuers {
+		if !is.Opaque {
+			continue
+		}
+		var tc *TokenContainer
+		tc, err = is.validate(ctx, token)
+		if err == nil {
+			return tc, nil
+		}
+		debugw("opaque token rejected by issuer", "issuer", is.Name, "flow_id", FlowIDFromContext(ctx), "error", err)
+	}
+	if err == nil {
+		err = invalidToken("untrusted token issuer", fmt.Errorf("%w: no issuer accepts opaque tokens", ErrUntrustedIssuer))
+	}
+	return nil, err
+}
+
+func (is Issuer) validate(ctx context.Context, token *oauth2.Token) (*TokenContainer, error) {
+	tc, err := is.Validator.Validate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if tc.issuer == "" {
+		tc.issuer = is.Name
+	}
+	return tc, nil
+}
+
+// ClaimMapping maps the claims of a JWT or an introspection response
+// to a TokenContainer.
+type ClaimMapping struct {
+	// UID is the claim stored as Scopes["uid"], defaults to "sub".
+	UID string
+	// Scope is the claim with the granted scopes, a space separated
+	// string or an array, defaults to "scope". Every scope is stored
+	// in Scopes with the value true.
+	Scope string
+	// Realm is the claim used as Realm, p.e.
+	// "https://identity.zalando.com/realm".
+	Realm string
+	// Claims are copied to Scopes with their values.
+	Claims []string
+}
+
+// container returns the TokenContainer for token with claims.
+func (m ClaimMapping) container(token *oauth2.Token, claims map[string]interface{}) *TokenContainer {
+	uid, scope := m.UID, m.Scope
+	if uid == "" {
+		uid = "sub"
+	}
+	if scope == "" {
+		scope = "scope"
+	}
+
+	scopes := make(map[string]interface{})
+	switch v := claims[scope].(type) {
+	case string:
+		for _, s := range strings.Fields(v) {
+			scopes[s] = true
+		}
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				scopes[s] = true
+			}
+		}
+	}
+	for _, c := range m.Claims {
+		if v, ok := claims[c]; ok {
+			scopes[c] = v
+		}
+	}
+	if v, ok := claims[uid].(string); ok {
+		scopes["uid"] = v
+	}
+
+	tc := &TokenContainer{
+		Token:     &oauth2.Token{AccessToken: token.AccessToken, TokenType: token.TokenType, Expiry: token.Expiry},
+		Scopes:    scopes,
+		Audience:  parseAudience(claims["aud"]),
+		RawClaims: claims,
+	}
+	if cnf, ok := claims["cnf"].(map[string]interface{}); ok {
+		tc.Confirmation = cnf
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		tc.Token.Expiry = time.Unix(int64(exp), 0)
+	}
+	if realm, ok := claims[m.Realm].(string); ok {
+		tc.Realm = realm
+	}
+	if gt, ok := claims["grant_type"].(string); ok {
+		tc.GrantType = gt
+	}
+	if iss, ok := claims["iss"].(string); ok {
+		tc.issuer = iss
+	}
+	if jti, ok := claims["jti"].(string); ok {
+		tc.JTI = jti
+	}
+	tc.setAuthentication(claims)
+	return tc
+}
+
+// TokenInfoValidator validates tokens with a tokeninfo service like
+// Options.Endpoint does.
+type TokenInfoValidator struct {
+	URL                 string
+	AccessTokenInHeader bool
+}
+
+// Validate implements Validator.
+func (v TokenInfoValidator) Validate(ctx context.Context, token *oauth2.Token) (*TokenContainer, error) {
+	return getTokenContainerForToken(ctx, Options{
+		Endpoint:            oauth2.Endpoint{TokenURL: v.URL},
+		AccessTokenInHeader: v.AccessTokenInHeader,
+	}, token)
+}
+
+// IntrospectionValidator validates tokens with an OAuth 2.0 Token
+// Introspection endpoint (RFC 7662).
+type IntrospectionValidator struct {
+	URL string
+	// ClientID and ClientSecret authenticate the introspection request
+	// with HTTP Basic authentication.
+	ClientID     string
+	ClientSecret string
+	// TokenSource authenticates the introspection request with a
+	// bearer token instead, p.e. a ServiceTokenSource. If neither
+	// TokenSource nor ClientID is set, Options.ServiceTokenSource is
+	// used.
+	TokenSource oauth2.TokenSource
+	Mapping     ClaimMapping
+}
+
+// Validate implements Validator.
+func (v IntrospectionValidator) Validate(ctx context.Context, token *oauth2.Token) (*TokenContainer, error) {
+	form := url.Values{"token": {token.AccessToken}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, newAuthError(http.StatusUnauthorized, ErrUnavailable, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	SetFlowIDHeader(ctx, req)
+	ts := v.TokenSource
+	if ts == nil && v.ClientID == "" {
+		ts, _ = ServiceTokenSourceFromContext(ctx)
+	}
+	if ts != nil {
+		t, err := ts.Token()
+		if err != nil {
+			return nil, newAuthError(http.StatusUnauthorized, ErrUnavailable, err)
+		}
+		t.SetAuthHeader(req)
+	} else if v.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(v.ClientID), url.QueryEscape(v.ClientSecret))
+	}
+
+	client := &http.Client{Transport: &Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, newAuthError(http.StatusUnauthorized, ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAuthError(http.StatusUnauthorized, ErrUnavailable, fmt.Errorf("introspection returned %s", resp.Status))
+	}
+	var claims map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, newAuthError(http.StatusUnauthorized, ErrUnavailable, err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, invalidToken("token is not active", errors.New("introspection: token is not active"))
+	}
+	return v.Mapping.container(token, claims), nil
+}
+
+// DefaultJWKSMaxAge is the time a JWKSValidator caches the keys.
+const DefaultJWKSMaxAge = time.Hour
+
+// jwksMinRefresh limits refetching the JWKS for unknown key ids.
+const jwksMinRefresh = 30 * time.Second
+
+// JWKSValidator validates JWT access tokens locally with the keys
+// published at URL, p.e. the jwks_uri of an OIDC issuer. The signature,
+// exp, nbf and, if Issuer is set, iss are validated. Keys are cached
+// for MaxAge and refetched if a token uses an unknown key id. The alg
+// of a token has to match the alg of its key, if the key has one.
+type JWKSValidator struct {
+	URL     string
+	Issuer  string        // expected iss claim
+	Leeway  time.Duration // allowed clock skew for exp and nbf
+	MaxAge  time.Duration // defaults to DefaultJWKSMaxAge
+	Mapping ClaimMapping
+
+	mu        sync.Mutex
+	keys      map[string]jwksKey
+	fetchedAt time.Time
+	inflight  *jwksFetch
+}
+
+// NewJWKSValidator returns a JWKSValidator for the issuer iss with the
+// keys published at jwksURL.
+func NewJWKSValidator(iss, jwksURL string, mapping ClaimMapping) *JWKSValidator {
+	return &JWKSValidator{URL: jwksURL, Issuer: iss, Mapping: mapping}
+}
+
+// Validate implements Validator.
+func (v *JWKSValidator) Validate(ctx context.Context, token *oauth2.Token) (*TokenContainer, error) {
+	jwt, err := parseJWT(token.AccessToken)
+	if err != nil {
+		return nil, invalidToken("malformed token", err)
+	}
+	key, err := v.key(ctx, jwt.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.alg != "" && key.alg != jwt.header.Alg {
+		return nil, invalidToken("invalid token signature", fmt.Errorf("jwks: key %q is restricted to alg %s, token uses %s", jwt.header.Kid, key.alg, jwt.header.Alg))
+	}
+	if err := jwt.verify(key.key); err != nil {
+		return nil, invalidToken("invalid token signature", err)
+	}
+	if err := validateTimeClaims(jwt.claims, v.Leeway); err != nil {
+		return nil, err
+	}
+	if v.Issuer != "" && jwt.claims["iss"] != v.Issuer {
+		return nil, invalidToken("untrusted token issuer", fmt.Errorf("%w %v", ErrUntrustedIssuer, jwt.claims["iss"]))
+	}
+	return v.Mapping.container(token, jwt.claims), nil
+}
+
+// validateTimeClaims validates exp and nbf of a JWT.
+func validateTimeClaims(claims map[string]interface{}, leeway time.Duration) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return invalidToken("token has no expiry", errors.New("jwt: missing exp claim"))
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return invalidToken("token expired", errors.New("jwt: token expired"))
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return invalidToken("token not yet valid", errors.New("jwt: token not yet valid"))
+	}
+	return nil
+}
+
+// jwksKey is a key of a JWKS and the alg it is restricted to, if any.
+type jwksKey struct {
+	key crypto.PublicKey
+	alg string
+}
+
+// jwksFetch is a fetch of the JWKS shared by all concurrent callers.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// key returns the key with the given key id. If the cache expired, the
+// cached key is returned while the JWKS is fetched in the background.
+// Unknown key ids wait for the fetch, at most every jwksMinRefresh.
+func (v *JWKSValidator) key(ctx context.Context, kid string) (jwksKey, error) {
+	maxAge := v.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultJWKSMaxAge
+	}
+
+	v.mu.Lock()
+	key, ok := v.lookup(kid)
+	age := time.Since(v.fetchedAt)
+	if ok {
+		if age > maxAge {
+			v.fetch(ctx)
+		}
+		v.mu.Unlock()
+		return key, nil
+	}
+	if age < jwksMinRefresh {
+		v.mu.Unlock()
+		return jwksKey{}, invalidToken("unknown signing key", fmt.Errorf("jwks: unknown key id %q", kid))
+	}
+	f := v.fetch(ctx)
+	v.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return jwksKey{}, newAuthError(http.StatusUnauthorized, ErrUnavailable, ctx.Err())
+	}
+	if f.err != nil {
+		return jwksKey{}, newAuthError(http.StatusUnauthorized, ErrUnavailable, f.err)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok = v.lookup(kid); !ok {
+		return jwksKey{}, invalidToken("unknown signing key", fmt.Errorf("jwks: unknown key id %q", kid))
+	}
+	return key, nil
+}
+
+// fetch starts fetching the JWKS unless a fetch is in flight. v.mu
+// must be held.
+func (v *JWKSValidator) fetch(ctx context.Context) *jwksFetch {
+	if v.inflight != nil {
+		return v.inflight
+	}
+	f := &jwksFetch{done: make(chan struct{})}
+	v.inflight = f
+	go func() {
+		fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), VarianceTimer)
+		defer cancel()
+		var keys map[string]jwksKey
+		keys, f.err = fetchJWKS(fctx, v.URL)
+		if f.err != nil {
+			errorw("Failed to fetch JWKS", "url", v.URL, "flow_id", FlowIDFromContext(ctx), "error", f.err)
+		}
+
+		v.mu.Lock()
+		if f.err == nil {
+			v.keys, v.fetchedAt = keys, time.Now()
+		}
+		v.inflight = nil
+		v.mu.Unlock()
+		close(f.done)
+	}()
+	return f
+}
+
+// lookup returns the key for kid. Tokens without kid are accepted if
+// the JWKS has a single key. v.mu must be held.
+func (v *JWKSValidator) lookup(kid string) (jwksKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	k, ok := v.keys[kid]
+	return k, ok
+}
+
+func fetchJWKS(ctx context.Context, jwksURL string) (map[string]jwksKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	SetFlowIDHeader(ctx, req)
+	client := &http.Client{Transport: &Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: %s returned %s", jwksURL, resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	keys := make(map[string]jwksKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			infow("Ignoring unsupported JWKS key", "url", jwksURL, "error", err)
+			continue
+		}
+		keys[k.Kid] = jwksKey{key: pk, alg: k.Alg}
+	}
+	return keys, nil
+}
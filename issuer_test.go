@@ -0,0 +1,267 @@
+package ginoauth2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+const testIssuerName = "https://oidc.example.org"
+
+// testIssuer is an OIDC issuer stand-in publishing an RSA and an EC
+// key as JWKS.
+type testIssuer struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	srv     *httptest.Server
+	fetches int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	ti := &testIssuer{}
+	var err error
+	ti.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ti.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "alg": "RS256", "n": b64(ti.rsa.N.Bytes()), "e": b64(big.NewInt(int64(ti.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": b64(ti.ec.X.FillBytes(make([]byte, 32))), "y": b64(ti.ec.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	}}
+	ti.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ti.fetches, 1)
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(ti.srv.Close)
+	return ti
+}
+
+func (ti *testIssuer) claims(extra map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"iss":   testIssuerName,
+		"sub":   "sszuecs",
+		"aud":   "orders",
+		"scope": "orders.read orders.write",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		c[k] = v
+	}
+	return c
+}
+
+func signJWT(t *testing.T, header, claims map[string]interface{}, sign func(input []byte) []byte) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	require.NoError(t, err)
+	c, err := json.Marshal(claims)
+	require.NoError(t, err)
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+}
+
+// sign returns an RS256 JWT with the given claims.
+func (ti *testIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	return signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1", "typ": "JWT"}, claims, func(input []byte) []byte {
+		sum := sha256.Sum256(input)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, ti.rsa, crypto.SHA256, sum[:])
+		require.NoError(t, err)
+		return sig
+	})
+}
+
+// signES returns an ES256 JWT with the given claims.
+func (ti *testIssuer) signES(t *testing.T, claims map[string]interface{}) string {
+	return signJWT(t, map[string]interface{}{"alg": "ES256", "kid": "ec-1"}, claims, func(input []byte) []byte {
+		sum := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, ti.ec, sum[:])
+		require.NoError(t, err)
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	})
+}
+
+func TestJWKSValidator(t *testing.T) {
+	ti := newTestIssuer(t)
+	other := newTestIssuer(t)
+	v := NewJWKSValidator(testIssuerName, ti.srv.URL, ClaimMapping{Realm: "realm", Claims: []string{"email"}})
+
+	for _, tok := range []string{
+		ti.sign(t, ti.claims(map[string]interface{}{"realm": "/employees", "email": "s@example.org"})),
+		ti.signES(t, ti.claims(map[string]interface{}{"realm": "/employees", "email": "s@example.org"})),
+	} {
+		tc, err := v.Validate(t.Context(), &oauth2.Token{AccessToken: tok, TokenType: "Bearer"})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{
+			"uid":          "sszuecs",
+			"orders.read":  true,
+			"orders.write": true,
+			"email":        "s@example.org",
+		}, tc.Scopes)
+		assert.Equal(t, "/employees", tc.Realm)
+		assert.Equal(t, []string{"orders"}, tc.Audience)
+		assert.Equal(t, testIssuerName, tc.Issuer())
+		assert.True(t, tc.Valid())
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&ti.fetches))
+
+	for name, tok := range map[string]string{
+		"expired":       ti.sign(t, ti.claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})),
+		"not yet valid": ti.sign(t, ti.claims(map[string]interface{}{"nbf": time.Now().Add(time.Minute).Unix()})),
+		"no expiry":     ti.sign(t, map[string]interface{}{"iss": testIssuerName}),
+		"wrong issuer":  ti.sign(t, ti.claims(map[string]interface{}{"iss": "https://evil.example.org"})),
+		"wrong key":     other.sign(t, ti.claims(nil)),
+		"alg none":      signJWT(t, map[string]interface{}{"alg": "none", "kid": "rsa-1"}, ti.claims(nil), func([]byte) []byte { return nil }),
+		"hmac":          signJWT(t, map[string]interface{}{"alg": "HS256", "kid": "hmac"}, ti.claims(nil), func([]byte) []byte { return []byte("x") }),
+		"opaque":        "opaque-token",
+		"curve of key": signJWT(t, map[string]interface{}{"alg": "ES384", "kid": "ec-1"}, ti.claims(nil), func(input []byte) []byte {
+			sum := sha512.Sum384(input)
+			r, s, err := ecdsa.Sign(rand.Reader, ti.ec, sum[:])
+			require.NoError(t, err)
+			return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}),
+		"alg of key": signJWT(t, map[string]interface{}{"alg": "PS256", "kid": "rsa-1"}, ti.claims(nil), func(input []byte) []byte {
+			sum := sha256.Sum256(input)
+			sig, err := rsa.SignPSS(rand.Reader, ti.rsa, crypto.SHA256, sum[:], nil)
+			require.NoError(t, err)
+			return sig
+		}),
+	} {
+		_, err := v.Validate(t.Context(), &oauth2.Token{AccessToken: tok})
+		assert.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+	// unknown key ids refetch the JWKS at most every jwksMinRefresh
+	assert.EqualValues(t, 1, atomic.LoadInt32(&ti.fetches))
+}
+
+func TestJWKSValidatorRefresh(t *testing.T) {
+	ti := newTestIssuer(t)
+	v := NewJWKSValidator(testIssuerName, ti.srv.URL, ClaimMapping{})
+	tok := &oauth2.Token{AccessToken: ti.sign(t, ti.claims(nil))}
+
+	// concurrent requests share a single fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := v.Validate(t.Context(), tok)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&ti.fetches))
+
+	// expired keys are used while the JWKS is refetched
+	ti.srv.Close()
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-2 * DefaultJWKSMaxAge)
+	v.mu.Unlock()
+	_, err := v.Validate(t.Context(), tok)
+	assert.NoError(t, err)
+}
+
+func TestIntrospectionValidator(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		assert.Equal(t, "my-service", user)
+		assert.Equal(t, "secret", pass)
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("token") != "active" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"active":    true,
+			"scope":     "orders.read",
+			"client_id": "stups_app",
+			"username":  "sszuecs",
+			"exp":       time.Now().Add(time.Hour).Unix(),
+		})
+	}))
+	defer srv.Close()
+
+	v := IntrospectionValidator{URL: srv.URL, ClientID: "my-service", ClientSecret: "secret", Mapping: ClaimMapping{UID: "username", Claims: []string{"client_id"}}}
+	tc, err := v.Validate(t.Context(), &oauth2.Token{AccessToken: "active"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"uid": "sszuecs", "orders.read": true, "client_id": "stups_app"}, tc.Scopes)
+
+	_, err = v.Validate(t.Context(), &oauth2.Token{AccessToken: "revoked"})
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	srv.Close()
+	_, err = v.Validate(t.Context(), &oauth2.Token{AccessToken: "active"})
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
+
+func TestIntrospectionValidatorServiceToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer service-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "username": "sszuecs"})
+	}))
+	defer srv.Close()
+
+	v := IntrospectionValidator{URL: srv.URL, Mapping: ClaimMapping{UID: "username"}}
+	_, err := v.Validate(t.Context(), &oauth2.Token{AccessToken: "active"})
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "service-token", TokenType: "Bearer"})
+	ctx := Options{ServiceTokenSource: ts}.withServiceTokenSource(t.Context())
+	tc, err := v.Validate(ctx, &oauth2.Token{AccessToken: "active"})
+	require.NoError(t, err)
+	assert.Equal(t, "sszuecs", tc.UID())
+}
+
+func TestIssuers(t *testing.T) {
+	ti := newTestIssuer(t)
+	legacy := newTokenInfoServer(t, nil)
+	var issuer string
+	check := func(tc *TokenContainer, ctx *gin.Context) bool {
+		issuer = tc.Issuer()
+		return true
+	}
+	router := newTestRouter(Options{Issuers: []Issuer{
+		{Name: "https://legacy.example.org", Validator: TokenInfoValidator{URL: legacy.URL}, Opaque: true},
+		{Name: testIssuerName, Validator: NewJWKSValidator(testIssuerName, ti.srv.URL, ClaimMapping{})},
+	}}, check)
+
+	assert.Equal(t, http.StatusOK, doRequest(router, bearer("opaque-token")).Code)
+	assert.Equal(t, "https://legacy.example.org", issuer)
+
+	assert.Equal(t, http.StatusOK, doRequest(router, bearer(ti.sign(t, ti.claims(nil)))).Code)
+	assert.Equal(t, testIssuerName, issuer)
+
+	w := doRequest(router, bearer(ti.sign(t, ti.claims(map[string]interface{}{"iss": "https://evil.example.org"}))))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer error="invalid_token", error_description="untrusted token issuer"`, w.Header().Get("WWW-Authenticate"))
+
+	// without opaque issuers, opaque tokens are rejected
+	router = newTestRouter(Options{Issuers: []Issuer{
+		{Name: testIssuerName, Validator: NewJWKSValidator(testIssuerName, ti.srv.URL, ClaimMapping{})},
+	}}, check)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(router, bearer("opaque-token")).Code)
+}
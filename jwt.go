@@ -0,0 +1,257 @@
+package ginoauth2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// jwtHeader is the JOSE header of a JWS.
+type jwtHeader struct {
+	Alg string          `json:"alg"`
+	Kid string          `json:"kid,omitempty"`
+	Typ string          `json:"typ,omitempty"`
+	JWK json.RawMessage `json:"jwk,omitempty"`
+}
+
+// parsedJWT is a JWS in compact serialization whose signature has not
+// been verified yet.
+type parsedJWT struct {
+	header       jwtHeader
+	claims       map[string]interface{}
+	signingInput string
+	signature    []byte
+}
+
+func parseJWT(token string) (*parsedJWT, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT")
+	}
+	var p parsedJWT
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if err := json.Unmarshal(b, &p.header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if b, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	if err := json.Unmarshal(b, &p.claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	if p.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, fmt.Errorf("invalid JWT signature: %w", err)
+	}
+	p.signingInput = parts[0] + "." + parts[1]
+	return &p, nil
+}
+
+// verify checks the signature of p with key.
+func (p *parsedJWT) verify(key crypto.PublicKey) error {
+	return verifySignature(p.header.Alg, key, []byte(p.signingInput), p.signature)
+}
+
+// verifySignature verifies a JWS signature of the asymmetric algorithms
+// RS*, PS*, ES* and EdDSA. Symmetric and "none" algorithms are
+// rejected.
+// ecCurves are the curves of the ECDSA algs (RFC 7518, section 3.4).
+var ecCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+func verifySignature(alg string, key crypto.PublicKey, input, sig []byte) error {
+	var h crypto.Hash
+	if len(alg) == 5 {
+		switch alg[2:] {
+		case "256":
+			h = crypto.SHA256
+		case "384":
+			h = crypto.SHA384
+		case "512":
+			h = crypto.SHA512
+		}
+	}
+	digest := func() []byte {
+		switch h {
+		case crypto.SHA256:
+			s := sha256.Sum256(input)
+			return s[:]
+		case crypto.SHA384:
+			s := sha512.Sum384(input)
+			return s[:]
+		default:
+			s := sha512.Sum512(input)
+			return s[:]
+		}
+	}
+
+	switch {
+	case alg == "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match alg %s", alg)
+		}
+		if !ed25519.Verify(k, input, sig) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	case h == 0:
+		return fmt.Errorf("unsupported JWT alg %q", alg)
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match alg %s", alg)
+		}
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(k, h, digest(), sig)
+		} else {
+			err = rsa.VerifyPSS(k, h, digest(), sig, nil)
+		}
+		if err != nil {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	case strings.HasPrefix(alg, "ES"):
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match alg %s", alg)
+		}
+		if want := ecCurves[alg]; k.Curve != want {
+			return fmt.Errorf("key curve %s does not match alg %s", k.Curve.Params().Name, alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid JWT signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest(), r, s) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported JWT alg %q", alg)
+}
+
+// jwk is a JSON Web Key as published in a JWKS.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	D   string `json:"d,omitempty"` // private key, must not be sent
+}
+
+// thumbprint returns the JWK SHA-256 Thumbprint (RFC 7638) of k,
+// base64url encoded.
+func (k jwk) thumbprint() (string, error) {
+	var members interface{}
+	switch k.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	default:
+		return "", fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey returns the public key of k.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA key %q: %w", k.Kid, err)
+		}
+		e, err := b64Int(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC key %q: %w", k.Kid, err)
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC key %q: %w", k.Kid, err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key %q", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
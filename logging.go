@@ -1,9 +1,13 @@
 package ginoauth2
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -15,6 +19,18 @@ type Logger interface {
 	Debugf(format string, args ...interface{})
 }
 
+// FieldLogger is a Logger that also supports structured logging with
+// alternating key/value pairs, p.e. Infow("access allowed", "uid",
+// "sszuecs", "path", "/api"). If DefaultLogger does not implement
+// FieldLogger, structured messages are rendered as key=value pairs and
+// passed to the printf-style methods.
+type FieldLogger interface {
+	Logger
+	Errorw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Debugw(msg string, keysAndValues ...interface{})
+}
+
 type glogLogger struct {
 	output io.Writer
 }
@@ -28,6 +44,7 @@ type glogLogger struct {
 //	import "github.com/zalando/gin-oauth2"
 //
 //	ginoauth2.DefaultLogger = &logrusLogger{} // use logrus
+//	ginoauth2.DefaultLogger = ginoauth2.NewSlogLogger(slog.Default().Handler()) // use log/slog
 var DefaultLogger Logger = &glogLogger{output: os.Stderr}
 
 func maskLogArgs(args ...interface{}) []interface{} {
@@ -38,6 +55,39 @@ func maskLogArgs(args ...interface{}) []interface{} {
 	return args
 }
 
+// maskFields masks all values of the given key/value pairs, keys are
+// kept as they are. Numbers, booleans and durations can not carry a
+// secret and keep their type for structured loggers.
+func maskFields(kv []interface{}) []interface{} {
+	for i := 1; i < len(kv); i += 2 {
+		switch kv[i].(type) {
+		case bool, int, int64, uint64, float64, time.Duration, time.Time:
+		default:
+			kv[i] = maskAccessToken(kv[i])
+		}
+	}
+	return kv
+}
+
+// formatFields renders msg and key/value pairs as "msg key=value ...".
+func formatFields(msg string, kv []interface{}) string {
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		sb.WriteByte(' ')
+		fmt.Fprint(&sb, kv[i])
+		sb.WriteByte('=')
+		if i+1 < len(kv) {
+			v := fmt.Sprint(kv[i+1])
+			if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+				v = fmt.Sprintf("%q", v)
+			}
+			sb.WriteString(v)
+		}
+	}
+	return sb.String()
+}
+
 // SetOutput sets the output destination for the logger
 func (gl *glogLogger) setOutput(w io.Writer) {
 	gl.output = w
@@ -69,14 +119,117 @@ func (gl *glogLogger) Debugf(f string, args ...interface{}) {
 	}
 }
 
-func errorf(f string, args ...interface{}) {
+// Errorw logs msg and key/value pairs using Errorf
+func (gl *glogLogger) Errorw(msg string, kv ...interface{}) {
+	gl.Errorf("%s", "[Gin-OAuth] "+formatFields(msg, kv))
+}
+
+// Infow logs msg and key/value pairs using Infof
+func (gl *glogLogger) Infow(msg string, kv ...interface{}) {
+	gl.Infof("%s", "[Gin-OAuth] "+formatFields(msg, kv))
+}
+
+// Debugw logs msg and key/value pairs using Debugf
+func (gl *glogLogger) Debugw(msg string, kv ...interface{}) {
+	gl.Debugf("%s", "[Gin-OAuth] "+formatFields(msg, kv))
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a FieldLogger that writes to the given
+// slog.Handler. Debug messages are logged with slog.LevelDebug.
+func NewSlogLogger(h slog.Handler) FieldLogger {
+	return &slogLogger{logger: slog.New(h).With("component", "gin-oauth2")}
+}
+
+func (sl *slogLogger) Errorf(f string, args ...interface{}) {
+	sl.logger.Error(fmt.Sprintf(f, args...))
+}
+
+func (sl *slogLogger) Infof(f string, args ...interface{}) {
+	sl.logger.Info(fmt.Sprintf(f, args...))
+}
+
+func (sl *slogLogger) Debugf(f string, args ...interface{}) {
+	sl.logger.Debug(fmt.Sprintf(f, args...))
+}
+
+func (sl *slogLogger) Errorw(msg string, kv ...interface{}) {
+	sl.logger.Log(context.Background(), slog.LevelError, msg, kv...)
+}
+
+func (sl *slogLogger) Infow(msg string, kv ...interface{}) {
+	sl.logger.Log(context.Background(), slog.LevelInfo, msg, kv...)
+}
+
+func (sl *slogLogger) Debugw(msg string, kv ...interface{}) {
+	sl.logger.Log(context.Background(), slog.LevelDebug, msg, kv...)
+}
+
+// maskingLogger forwards to the DefaultLogger at the time of the call
+// and masks access tokens in all arguments.
+type maskingLogger struct{}
+
+// Log returns a FieldLogger which masks secrets and forwards to
+// DefaultLogger. It is used by all packages of this module and can be
+// used by custom AccessCheckFunctions to log in the same way.
+func Log() FieldLogger {
+	return maskingLogger{}
+}
+
+func (maskingLogger) Errorf(f string, args ...interface{}) {
 	DefaultLogger.Errorf(f, maskLogArgs(args...)...)
 }
 
-func infof(f string, args ...interface{}) {
+func (maskingLogger) Infof(f string, args ...interface{}) {
 	DefaultLogger.Infof(f, maskLogArgs(args...)...)
 }
 
-func infofv2(f string, args ...interface{}) {
+func (maskingLogger) Debugf(f string, args ...interface{}) {
 	DefaultLogger.Debugf(f, maskLogArgs(args...)...)
 }
+
+func (maskingLogger) Errorw(msg string, kv ...interface{}) {
+	kv = maskFields(kv)
+	if fl, ok := DefaultLogger.(FieldLogger); ok {
+		fl.Errorw(msg, kv...)
+		return
+	}
+	DefaultLogger.Errorf("%s", "[Gin-OAuth] "+formatFields(msg, kv))
+}
+
+func (maskingLogger) Infow(msg string, kv ...interface{}) {
+	kv = maskFields(kv)
+	if fl, ok := DefaultLogger.(FieldLogger); ok {
+		fl.Infow(msg, kv...)
+		return
+	}
+	DefaultLogger.Infof("%s", "[Gin-OAuth] "+formatFields(msg, kv))
+}
+
+func (maskingLogger) Debugw(msg string, kv ...interface{}) {
+	kv = maskFields(kv)
+	if fl, ok := DefaultLogger.(FieldLogger); ok {
+		fl.Debugw(msg, kv...)
+		return
+	}
+	DefaultLogger.Debugf("%s", "[Gin-OAuth] "+formatFields(msg, kv))
+}
+
+func infof(f string, args ...interface{}) {
+	DefaultLogger.Infof(f, maskLogArgs(args...)...)
+}
+
+func errorw(msg string, kv ...interface{}) {
+	Log().Errorw(msg, kv...)
+}
+
+func infow(msg string, kv ...interface{}) {
+	Log().Infow(msg, kv...)
+}
+
+func debugw(msg string, kv ...interface{}) {
+	Log().Debugw(msg, kv...)
+}
@@ -2,9 +2,15 @@ package ginoauth2
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type mockLogger struct{ buffer bytes.Buffer }
@@ -43,3 +49,28 @@ func TestLogWithMaskedAccessToken(t *testing.T) {
 		})
 	}
 }
+
+func TestStructuredLogFallback(t *testing.T) {
+	mockLog := &mockLogger{}
+	DefaultLogger = mockLog
+
+	infow("access allowed", "uid", "sszuecs", "path", "/api?access_token=abcdefghijklmnop", "reason", "has space")
+
+	assert.Equal(t, `INFO: [Gin-OAuth] access allowed uid=sszuecs path=/api<MASK> reason="has space"`, mockLog.buffer.String())
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	DefaultLogger = NewSlogLogger(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	debugw("access allowed", "uid", "sszuecs", "duration", 3*time.Millisecond, "token", "&access_token=abcdefghijklmnop")
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "DEBUG", record["level"])
+	assert.Equal(t, "access allowed", record["msg"])
+	assert.Equal(t, "gin-oauth2", record["component"])
+	assert.Equal(t, "sszuecs", record["uid"])
+	assert.Equal(t, float64(3*time.Millisecond), record["duration"])
+	assert.Equal(t, "<MASK>", record["token"])
+}
@@ -0,0 +1,94 @@
+package ginoauth2
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// CertificateBinding controls the verification of certificate bound
+// access tokens (RFC 8705), see Options.CertificateBinding.
+type CertificateBinding int
+
+const (
+	// CertificateBindingOff ignores the cnf claim of tokens.
+	CertificateBindingOff CertificateBinding = iota
+	// CertificateBindingIfBound verifies tokens with a cnf x5t#S256
+	// claim against the TLS client certificate and accepts unbound
+	// tokens.
+	CertificateBindingIfBound
+	// CertificateBindingRequired only accepts tokens bound to the TLS
+	// client certificate.
+	CertificateBindingRequired
+)
+
+// ErrCertificateBinding is returned if a certificate bound token is
+// not presented with the certificate it is bound to.
+var ErrCertificateBinding = errors.New("token is not bound to the client certificate")
+
+type clientCertificateKey struct{}
+
+// WithClientCertificate returns a copy of ctx carrying the TLS client
+// certificate of the connection. The middleware sets it from
+// http.Request.TLS, other integrations like gRPC have to set it before
+// calling Verify.
+func WithClientCertificate(ctx context.Context, cert *x509.Certificate) context.Context {
+	return context.WithValue(ctx, clientCertificateKey{}, cert)
+}
+
+// ClientCertificateFromContext returns the certificate stored by
+// WithClientCertificate.
+func ClientCertificateFromContext(ctx context.Context) (*x509.Certificate, bool) {
+	cert, ok := requestContext(ctx).Value(clientCertificateKey{}).(*x509.Certificate)
+	return cert, ok && cert != nil
+}
+
+// withClientCertificate adds the verified TLS client certificate of r
+// to its context.
+func withClientCertificate(r *http.Request) *http.Request {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return r
+	}
+	return r.WithContext(WithClientCertificate(r.Context(), r.TLS.PeerCertificates[0]))
+}
+
+// CertificateThumbprint returns the x5t#S256 value of cert, the
+// base64url encoded SHA-256 hash of its DER encoding.
+func CertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// checkCertificateBinding verifies the cnf x5t#S256 claim of tc
+// against the client certificate in ctx according to
+// o.CertificateBinding.
+func (o Options) checkCertificateBinding(ctx context.Context, tc *TokenContainer) error {
+	if o.CertificateBinding == CertificateBindingOff {
+		return nil
+	}
+	want, bound := tc.Confirmation["x5t#S256"].(string)
+	if !bound {
+		if o.CertificateBinding == CertificateBindingRequired {
+			return bindingError("token is not certificate bound")
+		}
+		return nil
+	}
+	cert, ok := ClientCertificateFromContext(ctx)
+	if !ok {
+		return bindingError("no client certificate presented")
+	}
+	if CertificateThumbprint(cert) != want {
+		return bindingError("certificate thumbprint mismatch")
+	}
+	return nil
+}
+
+func bindingError(reason string) *AuthError {
+	ae := newAuthError(http.StatusUnauthorized, ErrInvalidToken, ErrCertificateBinding)
+	ae.Code = "invalid_token"
+	ae.Description = reason
+	return ae
+}
@@ -0,0 +1,122 @@
+package ginoauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// newTestCA returns a CA and a function issuing client certificates
+// signed by it.
+func newTestCA(t *testing.T) (*x509.CertPool, func(cn string) tls.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	serial := int64(1)
+	issue := func(cn string) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		serial++
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	}
+	return pool, issue
+}
+
+func TestCertificateBinding(t *testing.T) {
+	pool, issue := newTestCA(t)
+	certA, certB := issue("service-a"), issue("service-b")
+
+	bound := newTokenInfoServer(t, map[string]interface{}{"cnf": map[string]interface{}{"x5t#S256": CertificateThumbprint(certA.Leaf)}})
+	unbound := newTokenInfoServer(t, nil)
+
+	do := func(tokeninfo string, mode CertificateBinding, cert *tls.Certificate) int {
+		srv := httptest.NewUnstartedServer(newTestRouter(Options{
+			Endpoint:           oauth2.Endpoint{TokenURL: tokeninfo},
+			CertificateBinding: mode,
+		}, allowAll))
+		srv.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+		srv.StartTLS()
+		defer srv.Close()
+
+		client := srv.Client()
+		if cert != nil {
+			client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/private/1", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, do(bound.URL, CertificateBindingOff, &certB))
+
+	assert.Equal(t, http.StatusOK, do(bound.URL, CertificateBindingIfBound, &certA))
+	assert.Equal(t, http.StatusUnauthorized, do(bound.URL, CertificateBindingIfBound, &certB))
+	assert.Equal(t, http.StatusUnauthorized, do(bound.URL, CertificateBindingIfBound, nil))
+	assert.Equal(t, http.StatusOK, do(unbound.URL, CertificateBindingIfBound, nil))
+
+	assert.Equal(t, http.StatusOK, do(bound.URL, CertificateBindingRequired, &certA))
+	assert.Equal(t, http.StatusUnauthorized, do(unbound.URL, CertificateBindingRequired, &certA))
+}
+
+func TestCertificateBindingJWT(t *testing.T) {
+	_, issue := newTestCA(t)
+	cert := issue("service-a")
+	ti := newTestIssuer(t)
+	tok := ti.sign(t, ti.claims(map[string]interface{}{"cnf": map[string]interface{}{"x5t#S256": CertificateThumbprint(cert.Leaf)}}))
+	o := Options{
+		Issuers:            []Issuer{{Name: testIssuerName, Validator: NewJWKSValidator(testIssuerName, ti.srv.URL, ClaimMapping{})}},
+		CertificateBinding: CertificateBindingIfBound,
+	}
+
+	_, err := Verify(WithClientCertificate(t.Context(), cert.Leaf), o, &oauth2.Token{AccessToken: tok}, allowAllContext)
+	assert.NoError(t, err)
+
+	_, err = Verify(WithClientCertificate(t.Context(), issue("other").Leaf), o, &oauth2.Token{AccessToken: tok}, allowAllContext)
+	assert.ErrorIs(t, err, ErrCertificateBinding)
+	var ae *AuthError
+	require.ErrorAs(t, err, &ae)
+	assert.Equal(t, `Bearer error="invalid_token", error_description="certificate thumbprint mismatch"`, ae.Challenge("Bearer"))
+}
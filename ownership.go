@@ -0,0 +1,126 @@
+package ginoauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrNotOwner is returned by ownership checks if the requested resource
+// belongs to someone else.
+var ErrNotOwner = errors.New("resource belongs to another owner")
+
+// Ownership configures a check which grants access to resources of the
+// owner of the token, p.e. to /users/:uid/... for the user uid. The
+// owner of the resource is read from the route parameter Param, the
+// query parameter Query or the request header Header, the first one
+// configured, and compared to the claim Claim of the token. Route
+// parameters are the gin parameters or, with Handler, the wildcards of
+// the http.ServeMux pattern, p.e. "/users/{uid}/".
+//
+// Example:
+//
+//	users := router.Group("/users/:uid")
+//	users.Use(ginoauth2.AuthChainOptions(o, ginoauth2.AccessCheck(ginoauth2.Ownership{
+//		Param:          "uid",
+//		OverrideScopes: []string{"users.admin"},
+//	}.Check())))
+type Ownership struct {
+	Param  string
+	Query  string
+	Header string
+	// Claim is the claim of the token naming its owner, defaults to
+	// "uid". If Param, Query and Header are empty, it is also the name
+	// of the route parameter.
+	Claim string
+	// OverrideScopes grant access to resources of all owners, p.e. to
+	// administrators.
+	OverrideScopes []string
+	// Override, if set, grants access to resources of all owners if it
+	// returns nil, p.e. a role check of package rbac.
+	Override CheckFunction
+}
+
+// RequireOwner returns a CheckFunction that grants access if the
+// route parameter param equals the uid of the token or the token has
+// one of overrideScopes.
+func RequireOwner(param string, overrideScopes ...string) CheckFunction {
+	return Ownership{Param: param, OverrideScopes: overrideScopes}.Check()
+}
+
+// owner returns the requested owner of r and a description of its
+// source.
+func (o Ownership) owner(ctx context.Context, r *http.Request) (string, string) {
+	param := func(name string) string {
+		if gc, ok := ctx.(*gin.Context); ok {
+			return gc.Param(name)
+		}
+		return r.PathValue(name)
+	}
+	switch {
+	case o.Param != "":
+		return param(o.Param), "route parameter " + o.Param
+	case o.Query != "":
+		return r.URL.Query().Get(o.Query), "query parameter " + o.Query
+	case o.Header != "":
+		return r.Header.Get(o.Header), "header " + o.Header
+	}
+	return param(o.claim()), "route parameter " + o.claim()
+}
+
+func (o Ownership) claim() string {
+	if o.Claim == "" {
+		return "uid"
+	}
+	return o.Claim
+}
+
+// Check returns the CheckFunction of o. Requests are rejected with
+// 403 Forbidden. If OverrideScopes are set, the WWW-Authenticate header
+// asks for them with error="insufficient_scope".
+func (o Ownership) Check() CheckFunction {
+	return func(ctx context.Context, tc *TokenContainer) error {
+		for _, s := range o.OverrideScopes {
+			if tc.HasScope(s) {
+				debugw("Grant access by override scope", "flow_id", FlowIDFromContext(ctx), "uid", tc.UID(), "scope", s)
+				return nil
+			}
+		}
+		if o.Override != nil && o.Override(ctx, tc) == nil {
+			debugw("Grant access by override check", "flow_id", FlowIDFromContext(ctx), "uid", tc.UID())
+			return nil
+		}
+
+		r, ok := RequestFromContext(ctx)
+		if !ok {
+			return o.denied("request is missing, see WithRequest")
+		}
+		want, source := o.owner(ctx, r)
+		if want == "" {
+			return o.denied(source + " is missing")
+		}
+		have, _ := Claim[string](tc, o.claim())
+		if have == "" {
+			return o.denied("token has no " + o.claim())
+		}
+		if have != want {
+			return o.denied(fmt.Sprintf("%s does not match %s of the token", source, o.claim()))
+		}
+		return nil
+	}
+}
+
+func (o Ownership) denied(reason string) *AuthError {
+	ae := newAuthError(http.StatusForbidden, ErrForbidden, fmt.Errorf("%w: %s", ErrNotOwner, reason))
+	if len(o.OverrideScopes) > 0 {
+		// RFC 6750 only defines a code for missing scopes
+		ae.Code = "insufficient_scope"
+		ae.Description = reason
+		ae.Params = map[string]string{"scope": strings.Join(o.OverrideScopes, " ")}
+	}
+	return ae
+}
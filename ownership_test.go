@@ -0,0 +1,108 @@
+package ginoauth2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func newOwnershipRouter(t *testing.T, data map[string]interface{}, check CheckFunction) *gin.Engine {
+	srv := newTokenInfoServer(t, data)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(AuthChainOptions(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, AccessCheck(check)))
+	router.GET("/users/:uid/orders", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return router
+}
+
+func getOwned(router http.Handler, path string, hdr http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer token")
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRequireOwner(t *testing.T) {
+	router := newOwnershipRouter(t, nil, RequireOwner("uid", "users.admin"))
+
+	w := getOwned(router, "/users/sszuecs/orders", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = getOwned(router, "/users/njuettner/orders", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope", error_description="route parameter uid does not match uid of the token", scope="users.admin"`, w.Header().Get("WWW-Authenticate"))
+
+	admin := newOwnershipRouter(t, map[string]interface{}{"scope": []interface{}{"uid", "users.admin"}, "users.admin": true}, RequireOwner("uid", "users.admin"))
+	w = getOwned(admin, "/users/njuettner/orders", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestOwnership(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		check  Ownership
+		data   map[string]interface{}
+		path   string
+		hdr    http.Header
+		status int
+		reason string
+	}{
+		{"default param", Ownership{}, nil, "/users/sszuecs/orders", nil, http.StatusOK, ""},
+		{"query", Ownership{Query: "owner"}, nil, "/users/x/orders?owner=sszuecs", nil, http.StatusOK, ""},
+		{"missing query", Ownership{Query: "owner"}, nil, "/users/x/orders", nil, http.StatusForbidden, "query parameter owner is missing"},
+		{"header", Ownership{Header: "X-Owner"}, nil, "/users/x/orders", http.Header{"X-Owner": {"sszuecs"}}, http.StatusOK, ""},
+		{"claim", Ownership{Param: "uid", Claim: "sub"}, map[string]interface{}{"sub": "0b8a1c"}, "/users/0b8a1c/orders", nil, http.StatusOK, ""},
+		{"missing claim", Ownership{Param: "uid", Claim: "sub"}, nil, "/users/sszuecs/orders", nil, http.StatusForbidden, "token has no sub"},
+		{"mistyped claim", Ownership{Param: "uid"}, map[string]interface{}{"uid": 42}, "/users/42/orders", nil, http.StatusForbidden, "token has no uid"},
+		{"override check", Ownership{Param: "uid", Override: func(context.Context, *TokenContainer) error { return nil }}, nil, "/users/njuettner/orders", nil, http.StatusOK, ""},
+		{"failing override check", Ownership{Param: "uid", Override: func(context.Context, *TokenContainer) error { return errors.New("no admin") }}, nil, "/users/njuettner/orders", nil, http.StatusForbidden, "route parameter uid does not match uid of the token"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &memoryAuditSink{}
+			srv := newTokenInfoServer(t, tt.data)
+			router := gin.New()
+			router.Use(AuthChainOptions(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}, AuditSink: sink}, AccessCheck(tt.check.Check())))
+			router.GET("/users/:uid/orders", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+			w := getOwned(router, tt.path, tt.hdr)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.reason != "" {
+				// without OverrideScopes there is no RFC 6750 error code
+				assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+				assert.Contains(t, sink.last().Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestOwnershipOutsideGin(t *testing.T) {
+	tc := &TokenContainer{Scopes: map[string]interface{}{"uid": "sszuecs"}}
+	err := RequireOwner("uid")(context.Background(), tc)
+	assert.ErrorIs(t, err, ErrNotOwner)
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	srv := newTokenInfoServer(t, nil)
+	o := Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}
+	mux := http.NewServeMux()
+	mux.Handle("/users/{uid}/orders", Handler(o, RequireOwner("uid"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	mux.Handle("/orders", Handler(o, Ownership{Query: "owner"}.Check(), Ownership{Header: "X-Owner"}.Check())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	assert.Equal(t, http.StatusOK, getOwned(mux, "/users/sszuecs/orders", nil).Code)
+	assert.Equal(t, http.StatusForbidden, getOwned(mux, "/users/njuettner/orders", nil).Code)
+	assert.Equal(t, http.StatusOK, getOwned(mux, "/orders?owner=sszuecs", nil).Code)
+	assert.Equal(t, http.StatusOK, getOwned(mux, "/orders", http.Header{"X-Owner": {"sszuecs"}}).Code)
+	assert.Equal(t, http.StatusForbidden, getOwned(mux, "/orders?owner=njuettner", nil).Code)
+}
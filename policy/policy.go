@@ -0,0 +1,179 @@
+// Package policy implements attribute-based access checks written in
+// the Common Expression Language (CEL, https://cel.dev). Expressions
+// are compiled and type checked once, when the check is created, and
+// evaluated for every request with the token and request attributes.
+//
+// The following variables are available:
+//
+//	uid      string               uid of the token
+//	sub      string               subject of the token
+//	realm    string               realm of the token, p.e. "/employees"
+//	scopes   list(string)         granted scopes
+//	claims   map(string, dyn)     all claims of the tokeninfo response or JWT
+//	method   string               request method
+//	path     string               request path
+//	params   map(string, string)  route parameters, p.e. params.owner for /orders/:owner
+//	headers  map(string, string)  request headers, lower case names, values joined by ","
+//	query    map(string, string)  first value of each query parameter
+//	now      timestamp            time of the request
+//
+// Example:
+//
+//	owner := policy.MustNew(`(uid == params.owner || "admin" in scopes) && now.getHours("Europe/Berlin") < 18`)
+//	private.Use(ginoauth2.AuthChainOptions(o, owner.AccessCheck()))
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/cel-go/cel"
+	ginoauth2 "github.com/zalando/gin-oauth2"
+)
+
+// ErrDenied is returned by the checks of a Policy if its expression
+// evaluates to false.
+var ErrDenied = errors.New("denied by policy")
+
+var env = mustEnv()
+
+func mustEnv() *cel.Env {
+	e, err := cel.NewEnv(
+		cel.Variable("uid", cel.StringType),
+		cel.Variable("sub", cel.StringType),
+		cel.Variable("realm", cel.StringType),
+		cel.Variable("scopes", cel.ListType(cel.StringType)),
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("method", cel.StringType),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("params", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("query", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("now", cel.TimestampType),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// now returns the time of the request, replaced by tests.
+var now = time.Now
+
+// Policy is a compiled expression. It is safe for concurrent use.
+type Policy struct {
+	expr    string
+	program cel.Program
+}
+
+// New compiles expr. Syntax and type errors, and expressions not of
+// type bool, are returned as error.
+func New(expr string) (*Policy, error) {
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("policy %q: %w", expr, iss.Err())
+	}
+	if !ast.OutputType().IsExactType(cel.BoolType) {
+		return nil, fmt.Errorf("policy %q: expression of type %s, want bool", expr, ast.OutputType())
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("policy %q: %w", expr, err)
+	}
+	return &Policy{expr: expr, program: prg}, nil
+}
+
+// MustNew is like New but panics if expr does not compile. It
+// simplifies the initialization of package level checks.
+func MustNew(expr string) *Policy {
+	p, err := New(expr)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// String returns the expression of p.
+func (p *Policy) String() string {
+	return p.expr
+}
+
+// Evaluate evaluates p for tc and the request r with its route
+// parameters params, p.e. in handlers not using the gin middleware.
+// Errors at runtime, p.e. a missing claim, are returned with false.
+func (p *Policy) Evaluate(ctx context.Context, tc *ginoauth2.TokenContainer, r *http.Request, params map[string]string) (bool, error) {
+	out, _, err := p.program.ContextEval(ctx, activation(tc, r, params))
+	if err != nil {
+		return false, fmt.Errorf("policy %q: %w", p.expr, err)
+	}
+	granted, ok := out.Value().(bool)
+	return ok && granted, nil
+}
+
+func activation(tc *ginoauth2.TokenContainer, r *http.Request, params map[string]string) map[string]interface{} {
+	claims := make(map[string]interface{}, len(tc.Scopes)+len(tc.RawClaims))
+	// mapped claims in Scopes take precedence, see ginoauth2.Claim
+	for k, v := range tc.RawClaims {
+		claims[k] = v
+	}
+	for k, v := range tc.Scopes {
+		claims[k] = v
+	}
+	headers := make(map[string]string, len(r.Header))
+	for k, v := range r.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	query := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		query[k] = v[0]
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	return map[string]interface{}{
+		"uid":     tc.UID(),
+		"sub":     tc.Subject(),
+		"realm":   tc.Realm,
+		"scopes":  tc.ScopeList(),
+		"claims":  claims,
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"params":  params,
+		"headers": headers,
+		"query":   query,
+		"now":     now(),
+	}
+}
+
+// AccessCheck returns an AccessCheckFunction for the gin middleware,
+// which grants access if p evaluates to true.
+func (p *Policy) AccessCheck() ginoauth2.AccessCheckFunction {
+	return ginoauth2.AccessCheck(func(ctx context.Context, tc *ginoauth2.TokenContainer) error {
+		gc, ok := ctx.(*gin.Context)
+		if !ok {
+			return fmt.Errorf("policy %q: no gin.Context", p.expr)
+		}
+		params := make(map[string]string, len(gc.Params))
+		for _, param := range gc.Params {
+			params[param.Key] = param.Value
+		}
+		return p.check(gc, tc, gc.Request, params)
+	})
+}
+
+func (p *Policy) check(ctx context.Context, tc *ginoauth2.TokenContainer, r *http.Request, params map[string]string) error {
+	granted, err := p.Evaluate(ctx, tc, r, params)
+	if err != nil {
+		ginoauth2.Log().Infow("Policy evaluation failed", "flow_id", ginoauth2.FlowIDFromContext(ctx), "uid", tc.UID(), "error", err)
+		return &ginoauth2.AuthError{Status: http.StatusForbidden, Err: ginoauth2.ErrForbidden, Cause: err}
+	}
+	if !granted {
+		return &ginoauth2.AuthError{Status: http.StatusForbidden, Err: ginoauth2.ErrForbidden, Cause: fmt.Errorf("%w %q", ErrDenied, p.expr)}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ginoauth2 "github.com/zalando/gin-oauth2"
+	"golang.org/x/oauth2"
+)
+
+func TestNewReportsErrorsAtLoadTime(t *testing.T) {
+	for name, expr := range map[string]string{
+		"syntax":           `uid ==`,
+		"unknown variable": `user == "sszuecs"`,
+		"type mismatch":    `uid == 42`,
+		"not bool":         `uid`,
+	} {
+		_, err := New(expr)
+		assert.Error(t, err, name)
+	}
+	assert.Panics(t, func() { MustNew(`uid`) })
+	assert.Equal(t, `"admin" in scopes`, MustNew(`"admin" in scopes`).String())
+}
+
+func TestEvaluate(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2026, 10, 18, 15, 0, 0, 0, time.UTC) }
+
+	tc := &ginoauth2.TokenContainer{
+		Token:     &oauth2.Token{AccessToken: "token"},
+		Scopes:    map[string]interface{}{"uid": "sszuecs"},
+		Realm:     "/employees",
+		RawClaims: map[string]interface{}{"scope": "uid orders.read", "level": float64(3), "teams": []interface{}{"teapot"}},
+	}
+	r := httptest.NewRequest(http.MethodPut, "/orders/sszuecs?dry-run=true", nil)
+	r.Header.Set("X-Tenant", "de")
+
+	for _, tt := range []struct {
+		expr    string
+		granted bool
+	}{
+		{`uid == params.owner`, true},
+		{`uid == params.owner && now.getHours("UTC") < 18`, true},
+		{`now.getHours("UTC") < 12`, false},
+		{`"orders.read" in scopes && !("orders.write" in scopes)`, true},
+		{`realm == "/employees" && method == "PUT" && path.startsWith("/orders/")`, true},
+		{`headers["x-tenant"] == "de" && query["dry-run"] == "true"`, true},
+		{`claims.level >= 3 && "teapot" in claims.teams`, true},
+		{`claims.level > 3`, false},
+		{`sub == "sszuecs"`, true},
+	} {
+		granted, err := MustNew(tt.expr).Evaluate(context.Background(), tc, r, map[string]string{"owner": "sszuecs"})
+		assert.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.granted, granted, tt.expr)
+	}
+
+	_, err := MustNew(`claims.missing == "x"`).Evaluate(context.Background(), tc, r, nil)
+	assert.Error(t, err)
+}
+
+func TestAccessCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "token", "token_type": "Bearer", "expires_in": 3600, "realm": "/employees", "scope": ["uid"], "uid": "sszuecs"}`))
+	}))
+	defer srv.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	owner := MustNew(`uid == params.owner || "admin" in scopes`)
+	router.Use(ginoauth2.AuthChainOptions(ginoauth2.Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, owner.AccessCheck()))
+	router.GET("/orders/:owner", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for path, status := range map[string]int{
+		"/orders/sszuecs":   http.StatusOK,
+		"/orders/njuettner": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, status, w.Code, path)
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	tc := &ginoauth2.TokenContainer{Token: &oauth2.Token{AccessToken: "token"}}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	err := MustNew(`uid == "sszuecs"`).check(context.Background(), tc, r, nil)
+	var ae *ginoauth2.AuthError
+	require.True(t, errors.As(err, &ae))
+	assert.Equal(t, http.StatusForbidden, ae.Status)
+	assert.ErrorIs(t, err, ErrDenied)
+
+	err = MustNew(`claims.level > 1`).check(context.Background(), tc, r, nil)
+	require.True(t, errors.As(err, &ae))
+	assert.Equal(t, http.StatusForbidden, ae.Status)
+	assert.NotErrorIs(t, err, ErrDenied)
+}
@@ -0,0 +1,118 @@
+package ginoauth2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type inboundHeaderKey struct{}
+
+// withInbound returns ctx carrying the TokenContainer and the headers
+// of the authorized incoming request.
+func withInbound(ctx context.Context, tc *TokenContainer, h http.Header) context.Context {
+	return context.WithValue(WithTokenContainer(ctx, tc), inboundHeaderKey{}, h)
+}
+
+// TokenPropagator is an http.RoundTripper that injects the token
+// validated by the Auth middleware into outgoing requests made on
+// behalf of the caller. The outgoing request must use the context of
+// the incoming request. The token is only sent to AllowedHosts over
+// https, such that it never reaches third parties. Sender-constrained
+// tokens (DPoP or cnf bound) are not propagated, because the
+// downstream service can not verify them without a proof of the
+// caller's key.
+//
+// Example:
+//
+//	client := &http.Client{Transport: &ginoauth2.TokenPropagator{
+//		AllowedHosts:   []string{"orders.example.org", "*.internal.example.org"},
+//		ForwardHeaders: []string{"Accept-Language"},
+//	}}
+//	private.GET("/orders", func(c *gin.Context) {
+//		req, _ := http.NewRequestWithContext(c.Request.Context(), "GET", "https://orders.example.org/api", nil)
+//		resp, err := client.Do(req)
+//		...
+//	})
+type TokenPropagator struct {
+	// Base is the RoundTripper used to send the requests, defaults to
+	// http.DefaultTransport.
+	Base http.RoundTripper
+	// AllowedHosts are host names the token is sent to. Entries of the
+	// form "*.example.org" match all subdomains of example.org. Other
+	// entries starting with "*" match nothing.
+	AllowedHosts []string
+	// ForwardHeaders are copied from the incoming request, if they are
+	// not set on the outgoing request.
+	ForwardHeaders []string
+	// AllowInsecure sends the token over plain http, p.e. to a sidecar
+	// on localhost. Tokens sent over http can be read by everyone on
+	// the network path.
+	AllowInsecure bool
+}
+
+func (p *TokenPropagator) base() http.RoundTripper {
+	if p.Base != nil {
+		return p.Base
+	}
+	return http.DefaultTransport
+}
+
+func (p *TokenPropagator) allowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range p.AllowedHosts {
+		h = strings.ToLower(h)
+		if strings.HasPrefix(h, "*") {
+			suffix, ok := strings.CutPrefix(h, "*.")
+			if ok && suffix != "" && strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// RoundTrip implements http.RoundTripper.
+func (p *TokenPropagator) RoundTrip(req *http.Request) (*http.Response, error) {
+	tc, ok := TokenContainerFromContext(req.Context())
+	if !ok || tc.Token == nil {
+		return p.base().RoundTrip(req)
+	}
+	if len(tc.Confirmation) > 0 || strings.EqualFold(tc.Token.TokenType, "DPoP") {
+		debugw("Sender-constrained token not propagated", "host", req.URL.Hostname(), "flow_id", FlowIDFromContext(req.Context()))
+		return p.base().RoundTrip(req)
+	}
+	if !p.allowed(req.URL.Hostname()) {
+		debugw("Token not propagated to host", "host", req.URL.Hostname(), "flow_id", FlowIDFromContext(req.Context()))
+		return p.base().RoundTrip(req)
+	}
+	if req.URL.Scheme != "https" && !p.AllowInsecure {
+		infow("Token not propagated over insecure connection", "host", req.URL.Hostname(), "scheme", req.URL.Scheme, "flow_id", FlowIDFromContext(req.Context()))
+		return p.base().RoundTrip(req)
+	}
+
+	out := req.Clone(req.Context())
+	if out.Header.Get("Authorization") == "" {
+		typ := tc.Token.TokenType
+		if typ == "" {
+			typ = "Bearer"
+		}
+		out.Header.Set("Authorization", fmt.Sprintf("%s %s", typ, tc.Token.AccessToken))
+	}
+	if in, ok := req.Context().Value(inboundHeaderKey{}).(http.Header); ok {
+		for _, h := range p.ForwardHeaders {
+			if out.Header.Get(h) == "" {
+				if vs := in.Values(h); len(vs) > 0 {
+					out.Header[http.CanonicalHeaderKey(h)] = append([]string(nil), vs...)
+				}
+			}
+		}
+	}
+	if out.Header.Get(FlowIDHeader) == "" {
+		SetFlowIDHeader(req.Context(), out)
+	}
+	return p.base().RoundTrip(out)
+}
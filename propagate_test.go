@@ -0,0 +1,127 @@
+package ginoauth2
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenPropagator(t *testing.T) {
+	var received http.Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	})
+	downstream := httptest.NewTLSServer(handler)
+	defer downstream.Close()
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	srv := newTokenInfoServer(t, nil)
+	router := newTestRouter(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, allowAll)
+
+	for i, tt := range []struct {
+		name      string
+		url       string
+		allowed   []string
+		insecure  bool
+		auth      string
+		forwarded string
+	}{
+		{"allowed host", downstream.URL, []string{"127.0.0.1"}, false, "Bearer token", "de-DE"},
+		{"not allowed host", downstream.URL, []string{"orders.example.org"}, false, "", ""},
+		{"no allowed hosts", downstream.URL, nil, false, "", ""},
+		{"http", plain.URL, []string{"127.0.0.1"}, false, "", ""},
+		{"http allowed insecure", plain.URL, []string{"127.0.0.1"}, true, "Bearer token", "de-DE"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &TokenPropagator{
+				Base:           downstream.Client().Transport,
+				AllowedHosts:   tt.allowed,
+				ForwardHeaders: []string{"Accept-Language"},
+				AllowInsecure:  tt.insecure,
+			}}
+			path := fmt.Sprintf("/call/%d", i)
+			router.GET(path, func(c *gin.Context) {
+				req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, tt.url, nil)
+				require.NoError(t, err)
+				resp, err := client.Do(req)
+				require.NoError(t, err)
+				resp.Body.Close()
+			})
+
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Authorization", "Bearer token")
+			req.Header.Set("Accept-Language", "de-DE")
+			req.Header.Set("X-Flow-ID", "JAh6xdAxMQiOXQp1")
+			router.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.auth, received.Get("Authorization"))
+			assert.Equal(t, tt.forwarded, received.Get("Accept-Language"))
+		})
+	}
+}
+
+func TestTokenPropagatorAllowedHosts(t *testing.T) {
+	p := &TokenPropagator{AllowedHosts: []string{"orders.example.org", "*.internal.example.org"}}
+
+	assert.True(t, p.allowed("orders.example.org"))
+	assert.True(t, p.allowed("Orders.Example.org"))
+	assert.True(t, p.allowed("a.internal.example.org"))
+	assert.False(t, p.allowed("internal.example.org"))
+	assert.False(t, p.allowed("orders.example.org.evil.com"))
+	assert.False(t, p.allowed("evilinternal.example.org"))
+
+	p = &TokenPropagator{AllowedHosts: []string{"*example.org", "*", "*."}}
+	assert.False(t, p.allowed("evilexample.org"))
+	assert.False(t, p.allowed("a.example.org"))
+	assert.False(t, p.allowed("example.org"))
+}
+
+func TestTokenPropagatorWithoutToken(t *testing.T) {
+	var auth string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer downstream.Close()
+
+	client := &http.Client{Transport: &TokenPropagator{AllowedHosts: []string{"127.0.0.1"}}}
+	resp, err := client.Get(downstream.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Empty(t, auth)
+}
+
+func TestTokenPropagatorBoundTokens(t *testing.T) {
+	var auth string
+	downstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer downstream.Close()
+	client := &http.Client{Transport: &TokenPropagator{Base: downstream.Client().Transport, AllowedHosts: []string{"127.0.0.1"}}}
+
+	for _, tt := range []struct {
+		name string
+		tc   *TokenContainer
+		auth string
+	}{
+		{"bearer", &TokenContainer{Token: &oauth2.Token{AccessToken: "token", TokenType: "Bearer"}}, "Bearer token"},
+		{"dpop", &TokenContainer{Token: &oauth2.Token{AccessToken: "token", TokenType: "DPoP"}}, ""},
+		{"cnf", &TokenContainer{Token: &oauth2.Token{AccessToken: "token", TokenType: "Bearer"}, Confirmation: map[string]interface{}{"x5t#S256": "abc"}}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			auth = ""
+			req, err := http.NewRequestWithContext(WithTokenContainer(t.Context(), tt.tc), http.MethodGet, downstream.URL, nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.auth, auth)
+		})
+	}
+}
@@ -0,0 +1,417 @@
+// Package rbac maps tokens to application roles. Bindings grant roles
+// to realms, uids, teams and scopes, and roles inherit the bindings of
+// the roles they include.
+//
+// Example:
+//
+//	policy, err := rbac.LoadFile("/etc/my-service/rbac.json")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	admin := router.Group("/api/admin")
+//	admin.Use(ginoauth2.AuthChainOptions(o, ginoauth2.AccessCheck(policy.RequireRole("order-admin"))))
+//	admin.GET("/", func(c *gin.Context) {
+//		if policy.HasRole(c, "auditor") {
+//			...
+//		}
+//	})
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	ginoauth2 "github.com/zalando/gin-oauth2"
+	"github.com/zalando/gin-oauth2/zalando"
+)
+
+// ErrMissingRole is returned by RequireRole if the token has none of
+// the required roles.
+var ErrMissingRole = errors.New("missing role")
+
+// Role is an application role, p.e. "order-admin". Tokens with the
+// role also have all roles listed in Includes, p.e. "viewer".
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Includes    []string `json:"includes,omitempty"`
+}
+
+// Binding grants Role to tokens matching all non-empty fields of the
+// binding. A binding without conditions is rejected.
+type Binding struct {
+	Role  string `json:"role"`
+	Realm string `json:"realm,omitempty"` // p.e. "/employees", "/services"
+	UID   string `json:"uid,omitempty"`
+	Team  string `json:"team,omitempty"`  // team id, requires Policy.Teams
+	Scope string `json:"scope,omitempty"` // granted scope of the token
+}
+
+// Config is the serialized form of a Policy, p.e. a JSON file read by
+// LoadFile:
+//
+//	{
+//	  "roles": [
+//	    {"name": "viewer"},
+//	    {"name": "order-admin", "includes": ["viewer"]}
+//	  ],
+//	  "bindings": [
+//	    {"role": "order-admin", "team": "teapot"},
+//	    {"role": "viewer", "realm": "/services", "scope": "orders.read"}
+//	  ]
+//	}
+type Config struct {
+	Roles    []Role    `json:"roles"`
+	Bindings []Binding `json:"bindings"`
+}
+
+// TeamsFunc returns the ids of the teams of the owner of tc.
+type TeamsFunc func(ctx context.Context, tc *ginoauth2.TokenContainer) ([]string, error)
+
+// ZalandoTeams looks up the teams of the uid of tc in the
+// zalando.TeamAPI.
+func ZalandoTeams(ctx context.Context, tc *ginoauth2.TokenContainer) ([]string, error) {
+	blob, err := zalando.RequestTeamInfoContext(ctx, tc, zalando.TeamAPI)
+	if err != nil {
+		return nil, err
+	}
+	var data []zalando.TeamInfo
+	if err := json.Unmarshal(blob, &data); err != nil {
+		return nil, fmt.Errorf("failed to decode team info: %w", err)
+	}
+	teams := make([]string, 0, len(data))
+	for _, t := range data {
+		teams = append(teams, t.Id)
+	}
+	return teams, nil
+}
+
+// FromAccessTuples returns bindings granting role to the given
+// AccessTuples. Tuples with Realm "teams" bind the team Uid, as
+// zalando.GroupCheck does, all others the Realm and Uid as
+// zalando.UidCheck does.
+func FromAccessTuples(role string, tuples []zalando.AccessTuple) []Binding {
+	bindings := make([]Binding, 0, len(tuples))
+	for _, at := range tuples {
+		if at.Realm == "teams" {
+			bindings = append(bindings, Binding{Role: role, Team: at.Uid})
+		} else {
+			bindings = append(bindings, Binding{Role: role, Realm: at.Realm, UID: at.Uid})
+		}
+	}
+	return bindings
+}
+
+// Policy resolves the roles of tokens. It is safe for concurrent use.
+type Policy struct {
+	config Config
+	// includes are the roles each role includes, transitively and
+	// including the role itself.
+	includes map[string][]string
+	// Teams resolves team bindings. Defaults to ZalandoTeams, it is only
+	// called if a team binding is needed to decide, at most once per
+	// request. Set it before the Policy is used.
+	Teams TeamsFunc
+}
+
+// New validates config and returns its Policy. Bound and included
+// roles must be declared in config.Roles, and includes must not be
+// cyclic.
+func New(config Config) (*Policy, error) {
+	roles := make(map[string]Role, len(config.Roles))
+	for _, r := range config.Roles {
+		if r.Name == "" {
+			return nil, errors.New("rbac: role without name")
+		}
+		if _, ok := roles[r.Name]; ok {
+			return nil, fmt.Errorf("rbac: duplicate role %q", r.Name)
+		}
+		roles[r.Name] = r
+	}
+
+	p := &Policy{config: config, includes: make(map[string][]string, len(roles))}
+	for name := range roles {
+		seen := map[string]bool{}
+		var walk func(name string, path []string) error
+		walk = func(name string, path []string) error {
+			for _, n := range path {
+				if n == name {
+					return fmt.Errorf("rbac: cyclic includes %s", strings.Join(append(path, name), " -> "))
+				}
+			}
+			r, ok := roles[name]
+			if !ok {
+				return fmt.Errorf("rbac: role %q includes unknown role %q", path[len(path)-1], name)
+			}
+			seen[name] = true
+			for _, inc := range r.Includes {
+				if err := walk(inc, append(path, name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := walk(name, nil); err != nil {
+			return nil, err
+		}
+		for r := range seen {
+			p.includes[name] = append(p.includes[name], r)
+		}
+		sort.Strings(p.includes[name])
+	}
+
+	for _, b := range config.Bindings {
+		if _, ok := roles[b.Role]; !ok {
+			return nil, fmt.Errorf("rbac: binding of unknown role %q", b.Role)
+		}
+		if b.Realm == "" && b.UID == "" && b.Team == "" && b.Scope == "" {
+			return nil, fmt.Errorf("rbac: binding of role %q without conditions", b.Role)
+		}
+	}
+	return p, nil
+}
+
+// LoadFile reads a JSON Config from path and returns its Policy.
+func LoadFile(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("rbac: failed to parse %s: %w", path, err)
+	}
+	return New(config)
+}
+
+// Config returns the roles and bindings of p.
+func (p *Policy) Config() Config {
+	return Config{
+		Roles:    append([]Role(nil), p.config.Roles...),
+		Bindings: append([]Binding(nil), p.config.Bindings...),
+	}
+}
+
+// Grant is a role of a token and the binding granting it. Via is the
+// bound role if the role is included by another role.
+type Grant struct {
+	Role    string  `json:"role"`
+	Binding Binding `json:"binding"`
+	Via     string  `json:"via,omitempty"`
+}
+
+// Explain returns all grants of tc, p.e. to debug why a request was
+// denied.
+func (p *Policy) Explain(ctx context.Context, tc *ginoauth2.TokenContainer) ([]Grant, error) {
+	var teams map[string]bool
+	for _, b := range p.config.Bindings {
+		if b.Team != "" && matchesToken(b, tc) {
+			var err error
+			if teams, err = p.teams(ctx, tc); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	var grants []Grant
+	for _, b := range p.config.Bindings {
+		if !matchesToken(b, tc) || (b.Team != "" && !teams[b.Team]) {
+			continue
+		}
+		for _, r := range p.includes[b.Role] {
+			g := Grant{Role: r, Binding: b}
+			if r != b.Role {
+				g.Via = b.Role
+			}
+			grants = append(grants, g)
+		}
+	}
+	return grants, nil
+}
+
+// Roles returns the sorted roles of tc, including the included roles.
+func (p *Policy) Roles(ctx context.Context, tc *ginoauth2.TokenContainer) ([]string, error) {
+	grants, err := p.Explain(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(grants))
+	var roles []string
+	for _, g := range grants {
+		if !seen[g.Role] {
+			seen[g.Role] = true
+			roles = append(roles, g.Role)
+		}
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+// teamsKey caches the teams of the token of a request per Policy.
+type teamsKey struct {
+	p *Policy
+}
+
+// teamsResult is the result of the teams lookup of one request.
+type teamsResult struct {
+	once  sync.Once
+	teams map[string]bool
+	err   error
+}
+
+// cachedTeams returns the teams lookup of the request of ctx, kept in
+// the ginoauth2.RequestCache, such that HasRole in handlers reuses the
+// lookup of RequireRole. Without a request cache nothing is cached.
+func (p *Policy) cachedTeams(ctx context.Context) *teamsResult {
+	cache := ginoauth2.RequestCache(ctx)
+	if cache == nil {
+		return &teamsResult{}
+	}
+	r, _ := cache.LoadOrStore(teamsKey{p}, &teamsResult{})
+	return r.(*teamsResult)
+}
+
+func (p *Policy) teams(ctx context.Context, tc *ginoauth2.TokenContainer) (map[string]bool, error) {
+	if tc.UID() == "" {
+		return nil, nil
+	}
+	r := p.cachedTeams(ctx)
+	r.once.Do(func() {
+		lookup := p.Teams
+		if lookup == nil {
+			lookup = ZalandoTeams
+		}
+		var ids []string
+		if ids, r.err = lookup(ctx, tc); r.err != nil {
+			return
+		}
+		r.teams = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			r.teams[id] = true
+		}
+	})
+	return r.teams, r.err
+}
+
+// matchesToken reports whether tc matches all conditions of b except
+// the team.
+func matchesToken(b Binding, tc *ginoauth2.TokenContainer) bool {
+	return (b.Realm == "" || b.Realm == tc.Realm) &&
+		(b.UID == "" || b.UID == tc.UID()) &&
+		(b.Scope == "" || tc.HasScope(b.Scope))
+}
+
+// hasRole reports whether tc has one of roles. Bindings without team
+// are evaluated first, the teams are only looked up if no such binding
+// grants one of roles and a team binding would.
+func (p *Policy) hasRole(ctx context.Context, tc *ginoauth2.TokenContainer, roles []string) (string, error) {
+	grants := func(b Binding) string {
+		for _, r := range roles {
+			if contains(p.includes[b.Role], r) {
+				return r
+			}
+		}
+		return ""
+	}
+	var pending []Binding
+	for _, b := range p.config.Bindings {
+		r := grants(b)
+		if r == "" || !matchesToken(b, tc) {
+			continue
+		}
+		if b.Team == "" {
+			return r, nil
+		}
+		pending = append(pending, b)
+	}
+	if len(pending) == 0 {
+		return "", nil
+	}
+	teams, err := p.teams(ctx, tc)
+	if err != nil {
+		return "", err
+	}
+	for _, b := range pending {
+		if teams[b.Team] {
+			return grants(b), nil
+		}
+	}
+	return "", nil
+}
+
+// RequireRole returns a CheckFunction that grants access if the token
+// has one of the given roles. If the roles can only be granted by team
+// bindings and the teams of the token can not be looked up, the request
+// is rejected with 503 Service Unavailable.
+func (p *Policy) RequireRole(roles ...string) ginoauth2.CheckFunction {
+	return func(ctx context.Context, tc *ginoauth2.TokenContainer) error {
+		r, err := p.hasRole(ctx, tc, roles)
+		if err != nil {
+			return &ginoauth2.AuthError{Status: http.StatusServiceUnavailable, Err: ginoauth2.ErrUnavailable, Cause: err}
+		}
+		if r != "" {
+			ginoauth2.Log().Debugw("Grant access by role", "flow_id", ginoauth2.FlowIDFromContext(ctx), "uid", tc.UID(), "role", r)
+			return nil
+		}
+		return &ginoauth2.AuthError{Status: http.StatusForbidden, Err: ginoauth2.ErrForbidden, Cause: fmt.Errorf("%w: %s", ErrMissingRole, strings.Join(roles, ", "))}
+	}
+}
+
+// HasRole reports whether the token of an authorized request has one
+// of the given roles. ctx may be the *gin.Context or the context of the
+// *http.Request.
+func (p *Policy) HasRole(ctx context.Context, roles ...string) bool {
+	tc, ok := ginoauth2.TokenContainerFromContext(ctx)
+	if !ok {
+		return false
+	}
+	r, err := p.hasRole(ctx, tc, roles)
+	if err != nil {
+		ginoauth2.Log().Errorw("Failed to resolve roles", "flow_id", ginoauth2.FlowIDFromContext(ctx), "error", err)
+		return false
+	}
+	return r != ""
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// DebugHandler returns a handler serving the roles and bindings of p
+// as JSON and, if the request is authorized, the grants of its token.
+// Protect it like other administrative endpoints.
+func (p *Policy) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		resp := struct {
+			Config
+			Grants []Grant `json:"grants,omitempty"`
+		}{Config: p.Config()}
+		if tc, ok := ginoauth2.TokenContainerFromContext(r.Context()); ok {
+			grants, err := p.Explain(r.Context(), tc)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			resp.Grants = grants
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,230 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ginoauth2 "github.com/zalando/gin-oauth2"
+	"github.com/zalando/gin-oauth2/zalando"
+	"golang.org/x/oauth2"
+)
+
+var testConfig = Config{
+	Roles: []Role{
+		{Name: "viewer"},
+		{Name: "order-editor", Includes: []string{"viewer"}},
+		{Name: "order-admin", Includes: []string{"order-editor"}},
+	},
+	Bindings: []Binding{
+		{Role: "order-admin", Team: "teapot"},
+		{Role: "order-editor", Realm: "/employees", UID: "sszuecs"},
+		{Role: "viewer", Realm: "/services", Scope: "orders.read"},
+	},
+}
+
+func token(realm, uid string, scopes ...string) *ginoauth2.TokenContainer {
+	tc := &ginoauth2.TokenContainer{
+		Token:  &oauth2.Token{AccessToken: "token", TokenType: "Bearer"},
+		Scopes: map[string]interface{}{"uid": uid},
+		Realm:  realm,
+	}
+	for _, s := range scopes {
+		tc.Scopes[s] = true
+	}
+	return tc
+}
+
+func teams(ids ...string) TeamsFunc {
+	return func(context.Context, *ginoauth2.TokenContainer) ([]string, error) {
+		return ids, nil
+	}
+}
+
+func TestRoles(t *testing.T) {
+	p, err := New(testConfig)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name  string
+		tc    *ginoauth2.TokenContainer
+		teams TeamsFunc
+		roles []string
+	}{
+		{"team member", token("/employees", "njuettner"), teams("teapot"), []string{"order-admin", "order-editor", "viewer"}},
+		{"uid", token("/employees", "sszuecs"), teams(), []string{"order-editor", "viewer"}},
+		{"service scope", token("/services", "stups_orders", "orders.read"), teams(), []string{"viewer"}},
+		{"scope of wrong realm", token("/employees", "njuettner", "orders.read"), teams(), nil},
+		{"no binding", token("/employees", "njuettner"), teams("other"), nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p.Teams = tt.teams
+			roles, err := p.Roles(context.Background(), tt.tc)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.roles, roles)
+		})
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	for name, config := range map[string]Config{
+		"unknown bound role":         {Bindings: []Binding{{Role: "admin", UID: "sszuecs"}}},
+		"unknown include":            {Roles: []Role{{Name: "admin", Includes: []string{"viewer"}}}},
+		"cyclic include":             {Roles: []Role{{Name: "a", Includes: []string{"b"}}, {Name: "b", Includes: []string{"a"}}}},
+		"duplicate role":             {Roles: []Role{{Name: "a"}, {Name: "a"}}},
+		"binding without conditions": {Roles: []Role{{Name: "a"}}, Bindings: []Binding{{Role: "a"}}},
+	} {
+		_, err := New(config)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	p, err := New(testConfig)
+	require.NoError(t, err)
+	p.Teams = teams()
+	ctx := context.Background()
+
+	assert.NoError(t, p.RequireRole("viewer")(ctx, token("/employees", "sszuecs")))
+	assert.NoError(t, p.RequireRole("order-admin", "order-editor")(ctx, token("/employees", "sszuecs")))
+
+	err = p.RequireRole("order-admin")(ctx, token("/employees", "sszuecs"))
+	var ae *ginoauth2.AuthError
+	require.ErrorAs(t, err, &ae)
+	assert.Equal(t, http.StatusForbidden, ae.Status)
+	assert.ErrorIs(t, err, ErrMissingRole)
+
+	// the teams are only needed if no other binding grants the role
+	p.Teams = func(context.Context, *ginoauth2.TokenContainer) ([]string, error) {
+		return nil, errors.New("team API down")
+	}
+	assert.NoError(t, p.RequireRole("viewer")(ctx, token("/employees", "sszuecs")))
+	err = p.RequireRole("order-admin")(ctx, token("/employees", "sszuecs"))
+	require.ErrorAs(t, err, &ae)
+	assert.Equal(t, http.StatusServiceUnavailable, ae.Status)
+	err = p.RequireRole("order-admin")(ctx, token("/services", "stups_orders"))
+	require.ErrorAs(t, err, &ae)
+	assert.Equal(t, http.StatusServiceUnavailable, ae.Status)
+}
+
+func TestTeamsLookedUpOncePerRequest(t *testing.T) {
+	p, err := New(testConfig)
+	require.NoError(t, err)
+	lookups := 0
+	p.Teams = func(context.Context, *ginoauth2.TokenContainer) ([]string, error) {
+		lookups++
+		return []string{"teapot"}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token", "token_type": "Bearer", "expires_in": float64(3600),
+			"realm": "/employees", "scope": []interface{}{"uid"}, "uid": "njuettner",
+		})
+	}))
+	defer srv.Close()
+	router.Use(ginoauth2.AuthChainOptions(ginoauth2.Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}},
+		ginoauth2.AccessCheck(p.RequireRole("order-admin"))))
+	var isEditor, isViewer bool
+	router.GET("/", func(c *gin.Context) {
+		isEditor = p.HasRole(c, "order-editor")
+		isViewer = p.HasRole(c.Request.Context(), "viewer")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, isEditor)
+	assert.True(t, isViewer)
+	assert.Equal(t, 1, lookups)
+
+	// the same applies outside of gin
+	lookups, isEditor, isViewer = 0, false, false
+	h := ginoauth2.Handler(ginoauth2.Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, p.RequireRole("order-admin"))
+	h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isEditor = p.HasRole(r.Context(), "order-editor")
+		isViewer = p.HasRole(r.Context(), "viewer")
+	})).ServeHTTP(w, req)
+	assert.True(t, isEditor)
+	assert.True(t, isViewer)
+	assert.Equal(t, 1, lookups)
+}
+
+func TestHasRoleAndDebugHandler(t *testing.T) {
+	p, err := New(testConfig)
+	require.NoError(t, err)
+	p.Teams = teams()
+
+	tc := token("/employees", "sszuecs")
+	ctx := ginoauth2.WithTokenContainer(context.Background(), tc)
+	assert.True(t, p.HasRole(ctx, "viewer"))
+	assert.False(t, p.HasRole(ctx, "order-admin"))
+	assert.False(t, p.HasRole(context.Background(), "viewer"))
+
+	req := httptest.NewRequest(http.MethodGet, "/rbac", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	p.DebugHandler().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Config
+		Grants []Grant `json:"grants"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, testConfig, resp.Config)
+	binding := Binding{Role: "order-editor", Realm: "/employees", UID: "sszuecs"}
+	assert.Equal(t, []Grant{
+		{Role: "order-editor", Binding: binding},
+		{Role: "viewer", Binding: binding, Via: "order-editor"},
+	}, resp.Grants)
+}
+
+func TestLoadFileAndAccessTuples(t *testing.T) {
+	config := Config{Roles: []Role{{Name: "admin"}}}
+	config.Bindings = FromAccessTuples("admin", []zalando.AccessTuple{
+		{Realm: "/employees", Uid: "sszuecs", Cn: "Sandor Szücs"},
+		{Realm: "teams", Uid: "teapot", Cn: "Platform / Cloud API"},
+	})
+	assert.Equal(t, []Binding{
+		{Role: "admin", Realm: "/employees", UID: "sszuecs"},
+		{Role: "admin", Team: "teapot"},
+	}, config.Bindings)
+
+	path := filepath.Join(t.TempDir(), "rbac.json")
+	b, _ := json.Marshal(config)
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+	p, err := LoadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, config, p.Config())
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"bindings": [{"role": "admin", "uid": "sszuecs"}]}`), 0o600))
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+}
+
+func TestZalandoTeams(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "sszuecs", r.URL.Query().Get("member"))
+		json.NewEncoder(w).Encode([]zalando.TeamInfo{{Id: "teapot", Type: "official"}, {Id: "guild"}})
+	}))
+	defer srv.Close()
+	defer func(api string) { zalando.TeamAPI = api }(zalando.TeamAPI)
+	zalando.TeamAPI = srv.URL
+
+	p, err := New(testConfig)
+	require.NoError(t, err)
+	roles, err := p.Roles(context.Background(), token("/employees", "sszuecs"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"order-admin", "order-editor", "viewer"}, roles)
+}
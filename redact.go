@@ -0,0 +1,185 @@
+package ginoauth2
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RedactorConfig configures a Redactor. Use DefaultRedactorConfig to
+// start from the built-in rules and append your own.
+type RedactorConfig struct {
+	// Patterns are regular expressions matching secrets. If a pattern
+	// has a named group "secret", only that group is masked,
+	// otherwise the whole match.
+	Patterns []string
+	// HeaderNames are HTTP headers whose values are always masked,
+	// p.e. in "Authorization: Bearer x" or fmt output of an http.Header.
+	HeaderNames []string
+	// JSONKeys are keys whose string values are masked in JSON
+	// documents, p.e. {"refresh_token":"x"}.
+	JSONKeys []string
+	// Mask replaces every secret, defaults to "<MASK>".
+	Mask string
+}
+
+// DefaultRedactorConfig returns the rules used by DefaultRedactor. They
+// cover access_token, refresh_token, id_token, code and client_secret
+// parameters, Bearer, DPoP and Basic credentials of at least 20
+// characters, JWT shaped strings, the values of the Authorization,
+// Cookie and DPoP headers and the token fields of OAuth2 JSON
+// responses.
+func DefaultRedactorConfig() RedactorConfig {
+	return RedactorConfig{
+		Patterns: []string{
+			`[?&]access_token=[^&]+`,
+			`(?i)\b(?:access_token|refresh_token|id_token|subject_token|actor_token|code|client_secret|client_assertion|password)=(?P<secret>[^&\s"',;]+)`,
+			`(?i)\b(?:bearer|dpop|basic)\s+(?P<secret>[A-Za-z0-9\-._~+/]{20,}=*)`,
+			`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`,
+		},
+		HeaderNames: []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "DPoP", "X-Api-Key"},
+		JSONKeys:    []string{"access_token", "refresh_token", "id_token", "client_secret", "password", "assertion", "subject_token", "actor_token"},
+		Mask:        "<MASK>",
+	}
+}
+
+type redactPattern struct {
+	re     *regexp.Regexp
+	secret int // index of the "secret" group, 0 for the whole match
+}
+
+// Redactor masks secrets in strings and headers before they are
+// logged or audited.
+type Redactor struct {
+	mask     string
+	patterns []redactPattern
+	headers  map[string]bool
+}
+
+// NewRedactor compiles the given configuration.
+func NewRedactor(c RedactorConfig) (*Redactor, error) {
+	r := &Redactor{mask: c.Mask, headers: make(map[string]bool)}
+	if r.mask == "" {
+		r.mask = "<MASK>"
+	}
+
+	exprs := append([]string{}, c.Patterns...)
+	if len(c.HeaderNames) > 0 {
+		names := make([]string, len(c.HeaderNames))
+		for i, h := range c.HeaderNames {
+			names[i] = regexp.QuoteMeta(h)
+			r.headers[http.CanonicalHeaderKey(h)] = true
+		}
+		// the value is an optional scheme and one credential, or a
+		// list of cookies, but never the rest of the line
+		exprs = append(exprs, `(?i)\b(?:`+strings.Join(names, "|")+`)\s*[:=]\s*\[?(?P<secret>(?:[A-Za-z][A-Za-z0-9-]*[ \t]+)?[^\s\[\],;]+(?:;[ \t]*[^\s\[\],;]+)*)`)
+	}
+	if len(c.JSONKeys) > 0 {
+		keys := make([]string, len(c.JSONKeys))
+		for i, k := range c.JSONKeys {
+			keys[i] = regexp.QuoteMeta(k)
+		}
+		exprs = append(exprs, `"(?:`+strings.Join(keys, "|")+`)"\s*:\s*"(?P<secret>(?:[^"\\]|\\.)*)"`)
+	}
+
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", expr, err)
+		}
+		p := redactPattern{re: re}
+		if i := re.SubexpIndex("secret"); i > 0 {
+			p.secret = i
+		}
+		r.patterns = append(r.patterns, p)
+	}
+	return r, nil
+}
+
+func mustNewRedactor(c RedactorConfig) *Redactor {
+	r, err := NewRedactor(c)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// DefaultRedactor is applied to all log output and audit events.
+// Replace it at startup to change the redaction rules.
+//
+// Example:
+//
+//	c := ginoauth2.DefaultRedactorConfig()
+//	c.JSONKeys = append(c.JSONKeys, "api_key")
+//	r, err := ginoauth2.NewRedactor(c)
+//	if err != nil {
+//		glog.Fatalf("invalid redaction rules: %v", err)
+//	}
+//	ginoauth2.DefaultRedactor = r
+var DefaultRedactor = mustNewRedactor(DefaultRedactorConfig())
+
+// Redact masks all secrets found in s.
+func (r *Redactor) Redact(s string) string {
+	for _, p := range r.patterns {
+		matches := p.re.FindAllStringSubmatchIndex(s, -1)
+		if matches == nil {
+			continue
+		}
+		var sb strings.Builder
+		last := 0
+		for _, m := range matches {
+			start, end := m[2*p.secret], m[2*p.secret+1]
+			if start < 0 {
+				continue
+			}
+			sb.WriteString(s[last:start])
+			sb.WriteString(r.mask)
+			last = end
+		}
+		sb.WriteString(s[last:])
+		s = sb.String()
+	}
+	return s
+}
+
+// RedactHeader returns a copy of h where the values of all configured
+// header names are masked and all other values are redacted.
+func (r *Redactor) RedactHeader(h http.Header) http.Header {
+	res := make(http.Header, len(h))
+	for k, vs := range h {
+		masked := make([]string, len(vs))
+		for i, v := range vs {
+			if r.headers[http.CanonicalHeaderKey(k)] {
+				masked[i] = r.mask
+			} else {
+				masked[i] = r.Redact(v)
+			}
+		}
+		res[k] = masked
+	}
+	return res
+}
+
+// Redact masks all secrets in s using DefaultRedactor.
+func Redact(s string) string {
+	return DefaultRedactor.Redact(s)
+}
+
+type redactedError struct {
+	err error
+}
+
+func (e redactedError) Error() string { return Redact(e.err.Error()) }
+func (e redactedError) Unwrap() error { return e.err }
+
+// RedactError wraps err such that its message is redacted by
+// DefaultRedactor. errors.Is and errors.As still see the original
+// error. Use it for errors passed to gin.Context.AbortWithError which
+// may contain secrets, p.e. from oauth2.Config.Exchange.
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return redactedError{err: err}
+}
@@ -0,0 +1,159 @@
+package ginoauth2
+
+import (
+	"container/heap"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrReplayStoreFull is returned by a MemoryReplayStore if it can not
+// record a value without dropping one which did not expire yet.
+var ErrReplayStoreFull = errors.New("replay store full")
+
+// ReplayStore remembers one-time values like the jti of DPoP proofs
+// until they expire. Implementations backed by a shared store, p.e.
+// Redis, detect replays across instances of a service.
+type ReplayStore interface {
+	// Seen records key until exp and reports whether key was already
+	// recorded and did not expire yet. If key can not be recorded, an
+	// error is returned and the request is rejected.
+	Seen(key string, exp time.Time) (bool, error)
+}
+
+// DefaultReplayStoreSize is the maximum number of entries of a
+// MemoryReplayStore created by NewMemoryReplayStore.
+const DefaultReplayStoreSize = 100000
+
+// replayEntry is a recorded key ordered by its expiry.
+type replayEntry struct {
+	key string
+	exp time.Time
+}
+
+type replayHeap []replayEntry
+
+func (h replayHeap) Len() int            { return len(h) }
+func (h replayHeap) Less(i, j int) bool  { return h[i].exp.Before(h[j].exp) }
+func (h replayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x interface{}) { *h = append(*h, x.(replayEntry)) }
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// MemoryReplayStore is a bounded ReplayStore for a single instance.
+// Entries are kept until they expire. If it is full, new keys are
+// rejected with ErrReplayStoreFull, such that a flood of requests can
+// not push out recorded values and enable their replay.
+type MemoryReplayStore struct {
+	mu         sync.Mutex
+	entries    map[string]time.Time
+	byExpiry   replayHeap
+	maxEntries int
+}
+
+// NewMemoryReplayStore returns an empty MemoryReplayStore with up to
+// DefaultReplayStoreSize entries.
+func NewMemoryReplayStore() *MemoryReplayStore {
+	return NewMemoryReplayStoreSize(DefaultReplayStoreSize)
+}
+
+// NewMemoryReplayStoreSize returns an empty MemoryReplayStore with up
+// to maxEntries entries.
+func NewMemoryReplayStoreSize(maxEntries int) *MemoryReplayStore {
+	return &MemoryReplayStore{entries: make(map[string]time.Time), maxEntries: maxEntries}
+}
+
+// prune removes expired entries, the earliest expiring first. s.mu
+// must be held.
+func (s *MemoryReplayStore) prune(now time.Time) {
+	for len(s.byExpiry) > 0 && now.After(s.byExpiry[0].exp) {
+		e := heap.Pop(&s.byExpiry).(replayEntry)
+		if exp, ok := s.entries[e.key]; ok && exp.Equal(e.exp) {
+			delete(s.entries, e.key)
+		}
+	}
+}
+
+// Seen implements ReplayStore.
+func (s *MemoryReplayStore) Seen(key string, exp time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.prune(now)
+	if e, ok := s.entries[key]; ok && !now.After(e) {
+		return true, nil
+	}
+	if !now.Before(exp) {
+		// expired values can not be replayed
+		return false, nil
+	}
+	if s.maxEntries > 0 && len(s.entries) >= s.maxEntries {
+		return false, ErrReplayStoreFull
+	}
+	s.entries[key] = exp
+	heap.Push(&s.byExpiry, replayEntry{key: key, exp: exp})
+	return false, nil
+}
+
+// Len returns the number of entries, which did not expire yet.
+func (s *MemoryReplayStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	return len(s.entries)
+}
+
+// defaultOneTimeReplayStore records one-time tokens if
+// Options.ReplayStore is not set. It is not shared with DPoP proofs,
+// such that proofs can not fill the store of one-time tokens.
+var defaultOneTimeReplayStore = NewMemoryReplayStore()
+
+// replayUnavailable returns the error for a ReplayStore which can not
+// record a value.
+func replayUnavailable(err error) *AuthError {
+	errorw("Failed to record one-time value", "error", err)
+	return newAuthError(http.StatusServiceUnavailable, ErrUnavailable, err)
+}
+
+// ErrTokenReplayed is returned if Options.OneTimeTokens is set and the
+// token was already accepted before.
+var ErrTokenReplayed = errors.New("token replayed")
+
+// oneTimeTokenTTL is the time the jti of a token without expiry is
+// remembered.
+const oneTimeTokenTTL = 24 * time.Hour
+
+// checkReplay records the jti of tc and rejects tokens seen before.
+func (o Options) checkReplay(tc *TokenContainer) error {
+	if !o.OneTimeTokens {
+		return nil
+	}
+	if tc.JTI == "" {
+		return invalidToken("token has no jti", nil)
+	}
+	exp := tc.Token.Expiry
+	if exp.IsZero() {
+		exp = time.Now().Add(oneTimeTokenTTL)
+	}
+	store := o.ReplayStore
+	if store == nil {
+		store = defaultOneTimeReplayStore
+	}
+	seen, err := store.Seen("jti:"+tc.issuer+":"+tc.JTI, exp)
+	if err != nil {
+		return replayUnavailable(err)
+	}
+	if seen {
+		ae := newAuthError(http.StatusUnauthorized, ErrTokenReplayed, nil)
+		ae.Code = "invalid_token"
+		ae.Description = "token replayed"
+		return ae
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package ginoauth2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func seen(t *testing.T, s ReplayStore, key string, exp time.Time) bool {
+	t.Helper()
+	ok, err := s.Seen(key, exp)
+	require.NoError(t, err)
+	return ok
+}
+
+func TestMemoryReplayStore(t *testing.T) {
+	s := NewMemoryReplayStore()
+	assert.False(t, seen(t, s, "a", time.Now().Add(time.Minute)))
+	assert.True(t, seen(t, s, "a", time.Now().Add(time.Minute)))
+	assert.False(t, seen(t, s, "b", time.Now().Add(-time.Second)))
+	assert.False(t, seen(t, s, "b", time.Now().Add(time.Minute)))
+	assert.Equal(t, 2, s.Len())
+}
+
+func TestMemoryReplayStoreBounded(t *testing.T) {
+	s := NewMemoryReplayStoreSize(3)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		assert.False(t, seen(t, s, fmt.Sprint(i), now.Add(time.Minute)))
+	}
+	assert.False(t, seen(t, s, "short", now.Add(50*time.Millisecond)))
+
+	// a full store rejects new keys and keeps the recorded ones
+	_, err := s.Seen("3", now.Add(time.Hour))
+	assert.ErrorIs(t, err, ErrReplayStoreFull)
+	assert.True(t, seen(t, s, "0", now.Add(time.Minute)))
+	assert.True(t, seen(t, s, "1", now.Add(time.Minute)))
+
+	// expired entries free their space
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, seen(t, s, "3", now.Add(time.Hour)))
+	assert.True(t, seen(t, s, "3", now.Add(time.Hour)))
+	assert.Equal(t, 3, s.Len())
+}
+
+func TestOneTimeTokens(t *testing.T) {
+	ti := newTestIssuer(t)
+	router := newTestRouter(Options{
+		Issuers:       []Issuer{{Name: testIssuerName, Validator: NewJWKSValidator(testIssuerName, ti.srv.URL, ClaimMapping{})}},
+		OneTimeTokens: true,
+		ReplayStore:   NewMemoryReplayStore(),
+	}, allowAll)
+
+	tok := ti.sign(t, ti.claims(map[string]interface{}{"jti": "webhook-1"}))
+	assert.Equal(t, http.StatusOK, doRequest(router, bearer(tok)).Code)
+	w := doRequest(router, bearer(tok))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer error="invalid_token", error_description="token replayed"`, w.Header().Get("WWW-Authenticate"))
+
+	assert.Equal(t, http.StatusOK, doRequest(router, bearer(ti.sign(t, ti.claims(map[string]interface{}{"jti": "webhook-2"})))).Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(router, bearer(ti.sign(t, ti.claims(nil)))).Code)
+}
+
+func TestOneTimeTokensDeniedAreNotRecorded(t *testing.T) {
+	srv := newTokenInfoServer(t, map[string]interface{}{"jti": "webhook-1"})
+	o := Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}, OneTimeTokens: true, ReplayStore: NewMemoryReplayStore()}
+
+	assert.Equal(t, http.StatusForbidden, doRequest(newTestRouter(o, denyAll), bearer("token")).Code)
+	assert.Equal(t, http.StatusOK, doRequest(newTestRouter(o, allowAll), bearer("token")).Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(newTestRouter(o, allowAll), bearer("token")).Code)
+}
+
+func TestOneTimeTokensIntrospection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "jti": "webhook-1", "sub": "sender", "exp": time.Now().Add(time.Minute).Unix()})
+	}))
+	defer srv.Close()
+	o := Options{
+		Issuers:       []Issuer{{Name: "introspection", Validator: IntrospectionValidator{URL: srv.URL}, Opaque: true}},
+		OneTimeTokens: true,
+		ReplayStore:   NewMemoryReplayStore(),
+	}
+
+	_, err := Verify(t.Context(), o, &oauth2.Token{AccessToken: "opaque"}, allowAllContext)
+	assert.NoError(t, err)
+	_, err = Verify(t.Context(), o, &oauth2.Token{AccessToken: "opaque"}, allowAllContext)
+	assert.ErrorIs(t, err, ErrTokenReplayed)
+}
+
+func TestReplayStoreFull(t *testing.T) {
+	srv := newTokenInfoServer(t, map[string]interface{}{"jti": "webhook-1"})
+	store := NewMemoryReplayStoreSize(1)
+	_, err := store.Seen("other", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	o := Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}, OneTimeTokens: true, ReplayStore: store}
+
+	assert.Equal(t, http.StatusServiceUnavailable, doRequest(newTestRouter(o, allowAll), bearer("token")).Code)
+}
+
+func TestOneTimeTokensTimeoutNotRecorded(t *testing.T) {
+	defer func(d time.Duration) { VarianceTimer = d }(VarianceTimer)
+	srv := newTokenInfoServer(t, map[string]interface{}{"jti": "webhook-1"})
+	o := Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}, OneTimeTokens: true, ReplayStore: NewMemoryReplayStore()}
+	release := make(chan struct{})
+	slow := func(ctx context.Context, tc *TokenContainer) error {
+		<-release
+		return nil
+	}
+
+	VarianceTimer = 50 * time.Millisecond
+	_, err := Verify(t.Context(), o, &oauth2.Token{AccessToken: "token", TokenType: "Bearer"}, slow)
+	assert.ErrorIs(t, err, ErrTimeout)
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+
+	// the timed out request did not consume the jti
+	VarianceTimer = time.Second
+	_, err = Verify(t.Context(), o, &oauth2.Token{AccessToken: "token", TokenType: "Bearer"}, slow)
+	assert.NoError(t, err)
+	_, err = Verify(t.Context(), o, &oauth2.Token{AccessToken: "token", TokenType: "Bearer"}, slow)
+	assert.ErrorIs(t, err, ErrTokenReplayed)
+}
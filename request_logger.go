@@ -0,0 +1,143 @@
+package ginoauth2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestLoggerConfig configures RequestLoggerWithConfig.
+type RequestLoggerConfig struct {
+	// Methods to log. Defaults to all methods except GET, HEAD and
+	// OPTIONS.
+	Methods []string
+	// Keys are gin.Context keys whose values are logged as "keys",
+	// joined by "-", p.e. []string{"uid"}.
+	Keys []string
+	// ContentKey is a gin.Context key whose value is logged as "data"
+	// if it was set by the handler.
+	ContentKey string
+	// MaxBodySize enables logging of up to MaxBodySize bytes of the
+	// redacted request body.
+	MaxBodySize int
+	// SkipErrors does not log requests which added errors to the
+	// gin.Context, p.e. by AbortWithError.
+	SkipErrors bool
+}
+
+func (c RequestLoggerConfig) logMethod(method string) bool {
+	if len(c.Methods) == 0 {
+		return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+	}
+	for _, m := range c.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody reads up to n bytes of the request body and restores it,
+// such that handlers can read the full body.
+func readBody(r *http.Request, n int) []byte {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	buf, _ := io.ReadAll(io.LimitReader(r.Body, int64(n)))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	return buf
+}
+
+// RequestLoggerWithConfig is a middleware that writes a structured
+// audit line for every request with a configured method. It logs the
+// method, path, route, status, latency and, for requests authorized by
+// the Auth middleware, the uid and realm of the TokenContainer.
+//
+// Example:
+//
+//	router := gin.New()
+//	router.Use(ginoauth2.RequestLoggerWithConfig(ginoauth2.RequestLoggerConfig{
+//		Methods:     []string{"POST", "PUT", "DELETE"},
+//		MaxBodySize: 1024,
+//	}))
+func RequestLoggerWithConfig(c RequestLoggerConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !c.logMethod(ctx.Request.Method) {
+			ctx.Next()
+			return
+		}
+
+		t := time.Now()
+		var body []byte
+		if c.MaxBodySize > 0 {
+			body = readBody(ctx.Request, c.MaxBodySize)
+		}
+
+		ctx.Next()
+
+		if c.SkipErrors && len(ctx.Errors) > 0 {
+			return
+		}
+
+		fields := []interface{}{
+			"method", ctx.Request.Method,
+			"path", ctx.Request.URL.Path,
+			"route", ctx.FullPath(),
+			"status", ctx.Writer.Status(),
+			"duration", time.Since(t),
+			"flow_id", FlowIDFromContext(ctx.Request.Context()),
+		}
+		if tc, ok := TokenContainerFromContext(ctx.Request.Context()); ok {
+			fields = append(fields, "uid", tc.UID(), "realm", tc.Realm)
+		}
+		if len(c.Keys) > 0 {
+			values := make([]string, 0, len(c.Keys))
+			for _, key := range c.Keys {
+				if val, ok := ctx.Get(key); ok {
+					values = append(values, fmt.Sprint(val))
+				}
+			}
+			fields = append(fields, "keys", strings.Join(values, "-"))
+		}
+		if c.ContentKey != "" {
+			if data, ok := ctx.Get(c.ContentKey); ok {
+				fields = append(fields, "data", fmt.Sprintf("%+v", data))
+			}
+		}
+		if body != nil {
+			fields = append(fields, "body", string(body))
+		}
+		infow("Request", fields...)
+	}
+}
+
+// RequestLogger is a middleware that logs all the request and prints
+// relevant information.  This can be used for logging all the
+// requests that contain important information and are authorized.
+// The assumption is that the request to log has a content and an Id
+// identifiying who made the request uIdKey string to use as key to
+// get the uid from the context contentKey string to use as key to get
+// the content to be logged from the context.
+//
+// Deprecated: Use RequestLoggerWithConfig, which also logs the
+// authorized principal, status and latency.
+//
+// Example:
+//
+//	router := gin.Default()
+//	router.Use(ginoauth2.RequestLogger([]string{"uid"}, "data"))
+func RequestLogger(keys []string, contentKey string) gin.HandlerFunc {
+	return RequestLoggerWithConfig(RequestLoggerConfig{
+		Keys:       keys,
+		ContentKey: contentKey,
+		SkipErrors: true,
+	})
+}
@@ -0,0 +1,100 @@
+package ginoauth2
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestRequestLoggerWithConfig(t *testing.T) {
+	srv := newTokenInfoServer(t, nil)
+	gin.SetMode(gin.TestMode)
+
+	for _, tt := range []struct {
+		name    string
+		config  RequestLoggerConfig
+		method  string
+		status  int
+		body    string
+		logged  bool
+		expects []string
+	}{
+		{"GET is skipped by default", RequestLoggerConfig{}, http.MethodGet, http.StatusOK, "", false, nil},
+		{"HEAD is skipped by default", RequestLoggerConfig{}, http.MethodHead, http.StatusOK, "", false, nil},
+		{"POST is logged", RequestLoggerConfig{}, http.MethodPost, http.StatusCreated, "", true,
+			[]string{"method=POST", "path=/private/1", "route=/private/:id", "status=201", "uid=sszuecs", "realm=/employees"}},
+		{"DELETE is logged", RequestLoggerConfig{}, http.MethodDelete, http.StatusNoContent, "", true,
+			[]string{"method=DELETE", "status=204"}},
+		{"configured GET is logged", RequestLoggerConfig{Methods: []string{"get"}}, http.MethodGet, http.StatusOK, "", true,
+			[]string{"method=GET", "status=200"}},
+		{"unconfigured PUT is skipped", RequestLoggerConfig{Methods: []string{"POST"}}, http.MethodPut, http.StatusOK, "", false, nil},
+		{"failed request is logged", RequestLoggerConfig{}, http.MethodPost, http.StatusBadRequest, "", true,
+			[]string{"status=400"}},
+		{"failed request is skipped", RequestLoggerConfig{SkipErrors: true}, http.MethodPost, http.StatusBadRequest, "", false, nil},
+		{"keys and content", RequestLoggerConfig{Keys: []string{"uid", "count"}, ContentKey: "data"}, http.MethodPut, http.StatusOK, "", true,
+			[]string{"keys=sszuecs-42", "data=map[answer:42]"}},
+		{"bounded redacted body", RequestLoggerConfig{MaxBodySize: 40}, http.MethodPost, http.StatusOK, `{"password":"secret","name":"a very long name which is cut"}`, true,
+			[]string{`body="{\"password\":\"<MASK>\",\"name\":\"a very long"`}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockLog := &mockLogger{}
+			DefaultLogger = mockLog
+
+			router := gin.New()
+			router.Use(RequestLoggerWithConfig(tt.config))
+			router.Use(AuthChainOptions(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, allowAll))
+			router.Handle(tt.method, "/private/:id", func(c *gin.Context) {
+				body, _ := io.ReadAll(c.Request.Body)
+				assert.Equal(t, tt.body, string(body), "handler must see the full body")
+				c.Set("uid", "sszuecs")
+				c.Set("count", 42)
+				c.Set("data", map[string]int{"answer": 42})
+				if tt.status >= 400 {
+					c.AbortWithError(tt.status, assert.AnError)
+					return
+				}
+				c.Status(tt.status)
+			})
+
+			req := httptest.NewRequest(tt.method, "/private/1", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer token")
+			router.ServeHTTP(httptest.NewRecorder(), req)
+
+			var line string
+			for _, l := range strings.Split(mockLog.buffer.String(), "INFO: ") {
+				if strings.HasPrefix(l, "[Gin-OAuth] Request ") {
+					line = l
+				}
+			}
+			if !tt.logged {
+				assert.Empty(t, line)
+				return
+			}
+			for _, e := range tt.expects {
+				assert.Contains(t, line, e)
+			}
+		})
+	}
+}
+
+func TestRequestLoggerDoesNotPanicOnNonStringKeys(t *testing.T) {
+	mockLog := &mockLogger{}
+	DefaultLogger = mockLog
+
+	router := gin.New()
+	router.Use(RequestLogger([]string{"uid"}, "data"))
+	router.POST("/", func(c *gin.Context) {
+		c.Set("uid", 1070)
+		c.Set("data", "payload")
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+
+	assert.Contains(t, mockLog.buffer.String(), "keys=1070")
+	assert.Contains(t, mockLog.buffer.String(), "data=payload")
+}
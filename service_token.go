@@ -0,0 +1,150 @@
+package ginoauth2
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// DefaultRefreshBefore is the time before expiry at which a
+// ServiceTokenSource starts to refresh its token.
+const DefaultRefreshBefore = time.Minute
+
+// ServiceTokenSource is an oauth2.TokenSource for the identity of the
+// service itself, p.e. a client credentials grant. It caches the token
+// and refreshes it in the background RefreshBefore its expiry, such
+// that callers are not blocked while a still valid token exists.
+// Concurrent refreshes are collapsed into a single token request.
+//
+// Set it as Options.ServiceTokenSource to authenticate calls made by
+// this library, p.e. to the Teams API, or use it with oauth2.NewClient
+// for your own service to service calls.
+type ServiceTokenSource struct {
+	fetch         func(ctx context.Context) (*oauth2.Token, error)
+	refreshBefore time.Duration
+
+	mu       sync.Mutex
+	tok      *oauth2.Token
+	inflight *refreshCall
+}
+
+type refreshCall struct {
+	done chan struct{}
+	tok  *oauth2.Token
+	err  error
+}
+
+// NewServiceTokenSource returns a ServiceTokenSource requesting tokens
+// with the client credentials grant described by c. Tokens are
+// refreshed refreshBefore they expire, 0 defaults to
+// DefaultRefreshBefore. Token requests use Transport and are bounded by
+// VarianceTimer.
+//
+// Example:
+//
+//	ts := ginoauth2.NewServiceTokenSource(&clientcredentials.Config{
+//		ClientID:     "my-service",
+//		ClientSecret: secret,
+//		TokenURL:     "https://identity.example.org/oauth2/token",
+//		Scopes:       []string{"teams.read"},
+//	}, 0)
+//	router.Use(ginoauth2.AuthChainOptions(ginoauth2.Options{
+//		Endpoint:           zalando.OAuth2Endpoint,
+//		ServiceTokenSource: ts,
+//	}, zalando.GroupCheck(teams)))
+func NewServiceTokenSource(c *clientcredentials.Config, refreshBefore time.Duration) *ServiceTokenSource {
+	return newServiceTokenSource(func(ctx context.Context) (*oauth2.Token, error) {
+		return clientCredentialsToken(ctx, c)
+	}, refreshBefore)
+}
+
+// clientCredentialsToken requests a token with c using Transport.
+func clientCredentialsToken(ctx context.Context, c *clientcredentials.Config) (*oauth2.Token, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: &Transport})
+	return c.Token(ctx)
+}
+
+func newServiceTokenSource(fetch func(ctx context.Context) (*oauth2.Token, error), refreshBefore time.Duration) *ServiceTokenSource {
+	if refreshBefore <= 0 {
+		refreshBefore = DefaultRefreshBefore
+	}
+	return &ServiceTokenSource{fetch: fetch, refreshBefore: refreshBefore}
+}
+
+// Token returns the cached token. If it is about to expire a refresh is
+// started in the background. If no valid token is cached, Token waits
+// for the refresh.
+func (s *ServiceTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	tok := s.tok
+	if tok.Valid() {
+		if !tok.Expiry.IsZero() && time.Until(tok.Expiry) <= s.refreshBefore {
+			s.refresh()
+		}
+		s.mu.Unlock()
+		return tok, nil
+	}
+	c := s.refresh()
+	s.mu.Unlock()
+
+	<-c.done
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.tok, nil
+}
+
+// refresh starts a token request unless one is in flight. s.mu must be
+// held.
+func (s *ServiceTokenSource) refresh() *refreshCall {
+	if s.inflight != nil {
+		return s.inflight
+	}
+	c := &refreshCall{done: make(chan struct{})}
+	s.inflight = c
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), VarianceTimer)
+		defer cancel()
+		c.tok, c.err = s.fetch(ctx)
+		if c.err != nil {
+			errorw("service token refresh failed", "error", c.err)
+		}
+
+		s.mu.Lock()
+		if c.err == nil {
+			s.tok = c.tok
+		}
+		s.inflight = nil
+		s.mu.Unlock()
+		close(c.done)
+	}()
+	return c
+}
+
+type serviceTokenSourceKey struct{}
+
+// WithServiceTokenSource returns a copy of ctx carrying ts, see
+// ServiceTokenSourceFromContext.
+func WithServiceTokenSource(ctx context.Context, ts oauth2.TokenSource) context.Context {
+	return context.WithValue(ctx, serviceTokenSourceKey{}, ts)
+}
+
+// ServiceTokenSourceFromContext returns Options.ServiceTokenSource of
+// the middleware handling the request. Access checks use it to
+// authenticate calls made with the identity of the service.
+func ServiceTokenSourceFromContext(ctx context.Context) (oauth2.TokenSource, bool) {
+	ts, ok := requestContext(ctx).Value(serviceTokenSourceKey{}).(oauth2.TokenSource)
+	return ts, ok && ts != nil
+}
+
+// withServiceTokenSource adds o.ServiceTokenSource to ctx if it is set.
+func (o Options) withServiceTokenSource(ctx context.Context) context.Context {
+	if o.ServiceTokenSource == nil {
+		return ctx
+	}
+	return WithServiceTokenSource(ctx, o.ServiceTokenSource)
+}
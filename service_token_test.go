@@ -0,0 +1,108 @@
+package ginoauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+func TestServiceTokenSource(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "teams.read", r.PostForm.Get("scope"))
+		user, _, _ := r.BasicAuth()
+		assert.Equal(t, "my-service", user)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "service-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer srv.Close()
+
+	ts := NewServiceTokenSource(&clientcredentials.Config{
+		ClientID:     "my-service",
+		ClientSecret: "secret",
+		TokenURL:     srv.URL,
+		Scopes:       []string{"teams.read"},
+	}, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tok, err := ts.Token()
+			assert.NoError(t, err)
+			assert.Equal(t, "service-token", tok.AccessToken)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestServiceTokenSourceRefreshesEarly(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	ts := newServiceTokenSource(func(ctx context.Context) (*oauth2.Token, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n > 1 {
+			<-release
+		}
+		return &oauth2.Token{AccessToken: string(rune('a' + n - 1)), Expiry: time.Now().Add(30 * time.Second)}, nil
+	}, time.Minute)
+
+	first, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "a", first.AccessToken)
+
+	// the token expires within refreshBefore: the cached token is
+	// returned while a single refresh runs in the background
+	for i := 0; i < 5; i++ {
+		tok, err := ts.Token()
+		require.NoError(t, err)
+		assert.Equal(t, "a", tok.AccessToken)
+	}
+	close(release)
+	assert.Eventually(t, func() bool {
+		tok, _ := ts.Token()
+		return tok.AccessToken == "b"
+	}, time.Second, 5*time.Millisecond)
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&calls), int32(2))
+}
+
+func TestServiceTokenSourceError(t *testing.T) {
+	fail := errors.New("token endpoint down")
+	ts := newServiceTokenSource(func(ctx context.Context) (*oauth2.Token, error) {
+		return nil, fail
+	}, 0)
+
+	_, err := ts.Token()
+	assert.ErrorIs(t, err, fail)
+}
+
+func TestServiceTokenSourceFromContext(t *testing.T) {
+	_, ok := ServiceTokenSourceFromContext(context.Background())
+	assert.False(t, ok)
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "x"})
+	ctx := Options{ServiceTokenSource: ts}.withServiceTokenSource(context.Background())
+	got, ok := ServiceTokenSourceFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, ts, got)
+}
@@ -0,0 +1,91 @@
+package ginoauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInsufficientAuthentication is returned by RequireACR, RequireAMR
+// and MaxAuthAge if the login of the user does not meet the
+// requirements of the route.
+var ErrInsufficientAuthentication = errors.New("insufficient user authentication")
+
+// setAuthentication copies acr, amr and auth_time from claims.
+func (t *TokenContainer) setAuthentication(claims map[string]interface{}) {
+	if acr, ok := claims["acr"].(string); ok {
+		t.ACR = acr
+	}
+	switch amr := claims["amr"].(type) {
+	case []interface{}:
+		t.AMR = nil
+		for _, m := range amr {
+			if m, ok := m.(string); ok {
+				t.AMR = append(t.AMR, m)
+			}
+		}
+	case string:
+		t.AMR = strings.Fields(amr)
+	}
+	if at, ok := claims["auth_time"].(float64); ok {
+		t.AuthTime = time.Unix(int64(at), 0)
+	}
+}
+
+// stepUp returns the RFC 9470 challenge asking the client to
+// authenticate the user again with the given parameters.
+func stepUp(description string, params map[string]string) *AuthError {
+	ae := newAuthError(http.StatusUnauthorized, ErrInsufficientAuthentication, nil)
+	ae.Code = "insufficient_user_authentication"
+	ae.Description = description
+	ae.Params = params
+	return ae
+}
+
+// RequireACR returns a CheckFunction that grants access if the acr of
+// the token is one of the given values. Otherwise the client is asked
+// to request one of them with acr_values.
+func RequireACR(values ...string) CheckFunction {
+	return func(_ context.Context, tc *TokenContainer) error {
+		for _, v := range values {
+			if tc.ACR == v {
+				return nil
+			}
+		}
+		return stepUp("a different authentication level is required", map[string]string{"acr_values": strings.Join(values, " ")})
+	}
+}
+
+// RequireAMR returns a CheckFunction that grants access if the user
+// logged in with all of the given authentication methods, p.e.
+// RequireAMR("mfa").
+func RequireAMR(methods ...string) CheckFunction {
+	return func(_ context.Context, tc *TokenContainer) error {
+		for _, m := range methods {
+			found := false
+			for _, have := range tc.AMR {
+				found = found || have == m
+			}
+			if !found {
+				return stepUp(fmt.Sprintf("authentication method %s is required", m), nil)
+			}
+		}
+		return nil
+	}
+}
+
+// MaxAuthAge returns a CheckFunction that grants access if the user
+// logged in within d. Otherwise the client is asked to request a new
+// login with max_age.
+func MaxAuthAge(d time.Duration) CheckFunction {
+	return func(_ context.Context, tc *TokenContainer) error {
+		if !tc.AuthTime.IsZero() && time.Since(tc.AuthTime) <= d {
+			return nil
+		}
+		return stepUp("more recent authentication is required", map[string]string{"max_age": strconv.Itoa(int(d.Seconds()))})
+	}
+}
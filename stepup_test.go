@@ -0,0 +1,72 @@
+package ginoauth2
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestStepUpChecks(t *testing.T) {
+	recent := float64(time.Now().Add(-time.Minute).Unix())
+	old := float64(time.Now().Add(-time.Hour).Unix())
+
+	for _, tt := range []struct {
+		name      string
+		data      map[string]interface{}
+		check     CheckFunction
+		challenge string
+	}{
+		{"acr", map[string]interface{}{"acr": "gold"}, RequireACR("silver", "gold"), ""},
+		{"acr missing", nil, RequireACR("gold"), `Bearer error="insufficient_user_authentication", error_description="a different authentication level is required", acr_values="gold"`},
+		{"amr", map[string]interface{}{"amr": []interface{}{"pwd", "mfa"}}, RequireAMR("mfa"), ""},
+		{"amr missing", map[string]interface{}{"amr": []interface{}{"pwd"}}, RequireAMR("mfa"), `Bearer error="insufficient_user_authentication", error_description="authentication method mfa is required"`},
+		{"auth_time", map[string]interface{}{"auth_time": recent}, MaxAuthAge(5 * time.Minute), ""},
+		{"auth_time old", map[string]interface{}{"auth_time": old}, MaxAuthAge(5 * time.Minute), `Bearer error="insufficient_user_authentication", error_description="more recent authentication is required", max_age="300"`},
+		{"auth_time missing", nil, MaxAuthAge(5 * time.Minute), `Bearer error="insufficient_user_authentication", error_description="more recent authentication is required", max_age="300"`},
+		{"all", map[string]interface{}{"acr": "gold", "amr": []interface{}{"mfa"}, "auth_time": recent}, All(RequireACR("gold"), RequireAMR("mfa"), MaxAuthAge(time.Minute*5)), ""},
+		{"all fails", map[string]interface{}{"acr": "gold", "amr": []interface{}{"mfa"}, "auth_time": old}, All(RequireACR("gold"), RequireAMR("mfa"), MaxAuthAge(time.Minute*5)), `Bearer error="insufficient_user_authentication", error_description="more recent authentication is required", max_age="300"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTokenInfoServer(t, tt.data)
+			w := doRequest(newTestRouter(Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, AccessCheck(tt.check)), bearer("token"))
+			if tt.challenge == "" {
+				assert.Equal(t, http.StatusOK, w.Code)
+				return
+			}
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Equal(t, tt.challenge, w.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestAuthenticationClaims(t *testing.T) {
+	ti := newTestIssuer(t)
+	authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	tok := ti.sign(t, ti.claims(map[string]interface{}{"acr": "gold", "amr": []string{"pwd", "otp"}, "auth_time": authTime.Unix()}))
+
+	// claims of a JWT access token validated by tokeninfo are not
+	// verified, only those of the tokeninfo response are used
+	srv := newTokenInfoServer(t, nil)
+	tc, err := Verify(t.Context(), Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, &oauth2.Token{AccessToken: tok, TokenType: "Bearer"}, allowAllContext)
+	require.NoError(t, err)
+	assert.Empty(t, tc.ACR)
+	assert.Empty(t, tc.AMR)
+	assert.True(t, tc.AuthTime.IsZero())
+
+	srv = newTokenInfoServer(t, map[string]interface{}{"acr": "silver"})
+	tc, err = Verify(t.Context(), Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}, &oauth2.Token{AccessToken: tok, TokenType: "Bearer"}, allowAllContext)
+	require.NoError(t, err)
+	assert.Equal(t, "silver", tc.ACR)
+
+	// locally validated JWT
+	o := Options{Issuers: []Issuer{{Name: testIssuerName, Validator: NewJWKSValidator(testIssuerName, ti.srv.URL, ClaimMapping{})}}}
+	tc, err = Verify(t.Context(), o, &oauth2.Token{AccessToken: tok}, allowAllContext)
+	require.NoError(t, err)
+	assert.Equal(t, "gold", tc.ACR)
+	assert.Equal(t, []string{"pwd", "otp"}, tc.AMR)
+	assert.True(t, authTime.Equal(tc.AuthTime))
+}
@@ -0,0 +1,247 @@
+// Package tokenexchange implements OAuth 2.0 Token Exchange (RFC 8693)
+// to obtain audience and scope restricted tokens for downstream calls
+// made on behalf of the caller, instead of forwarding the caller's
+// full-scope token.
+//
+// Example:
+//
+//	orders := tokenexchange.NewExchanger(tokenexchange.Config{
+//		TokenURL:     "https://identity.example.org/oauth2/token",
+//		ClientID:     "my-service",
+//		ClientSecret: secret,
+//		Audience:     "orders",
+//		Scopes:       []string{"orders.read"},
+//	})
+//	private.GET("/orders", func(c *gin.Context) {
+//		tc, _ := ginoauth2.TokenContainerFromContext(c)
+//		client := oauth2.NewClient(c, orders.TokenSource(c, tc))
+//		resp, err := client.Get("https://orders.example.org/api")
+//		...
+//	})
+package tokenexchange
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	ginoauth2 "github.com/zalando/gin-oauth2"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// GrantType is the grant_type of a token exchange request.
+	GrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// AccessTokenType identifies an OAuth 2.0 access token.
+	AccessTokenType = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// expiryDelta is subtracted from the expiry of cached tokens, such
+// that a token does not expire while it is in flight.
+const expiryDelta = 10 * time.Second
+
+// Config describes the token exchange for one downstream service.
+type Config struct {
+	// TokenURL is the token exchange endpoint.
+	TokenURL string
+	// ClientID and ClientSecret authenticate this service with HTTP
+	// Basic authentication, if set.
+	ClientID     string
+	ClientSecret string
+	// Audience and Resource restrict where the exchanged token is
+	// accepted.
+	Audience string
+	Resource string
+	// Scopes requested for the exchanged token.
+	Scopes []string
+	// RequestedTokenType defaults to AccessTokenType.
+	RequestedTokenType string
+	// HTTPClient is used for exchange requests, defaults to a client
+	// using ginoauth2.Transport.
+	HTTPClient *http.Client
+	// MaxCacheSize limits the number of cached tokens, defaults to 1000.
+	MaxCacheSize int
+}
+
+// Exchanger performs token exchanges and caches the exchanged tokens
+// per subject token until they expire.
+type Exchanger struct {
+	c Config
+
+	mu    sync.Mutex
+	cache map[string]*oauth2.Token
+}
+
+// NewExchanger returns an Exchanger for the given configuration.
+func NewExchanger(c Config) *Exchanger {
+	if c.RequestedTokenType == "" {
+		c.RequestedTokenType = AccessTokenType
+	}
+	if c.MaxCacheSize <= 0 {
+		c.MaxCacheSize = 1000
+	}
+	return &Exchanger{c: c, cache: make(map[string]*oauth2.Token)}
+}
+
+func cacheKey(subjectToken string) string {
+	h := sha256.Sum256([]byte(subjectToken))
+	return hex.EncodeToString(h[:])
+}
+
+func (e *Exchanger) cached(key string) *oauth2.Token {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	t, ok := e.cache[key]
+	if !ok {
+		return nil
+	}
+	if !t.Expiry.IsZero() && time.Now().Add(expiryDelta).After(t.Expiry) {
+		delete(e.cache, key)
+		return nil
+	}
+	return t
+}
+
+func (e *Exchanger) store(key string, t *oauth2.Token) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.cache) >= e.c.MaxCacheSize {
+		now := time.Now()
+		for k, v := range e.cache {
+			if !v.Expiry.IsZero() && now.After(v.Expiry) {
+				delete(e.cache, k)
+			}
+		}
+		// still full: drop an arbitrary entry
+		for k := range e.cache {
+			if len(e.cache) < e.c.MaxCacheSize {
+				break
+			}
+			delete(e.cache, k)
+		}
+	}
+	e.cache[key] = t
+}
+
+// tokenResponse is the successful response of RFC 8693 section 2.2.1
+// or the error response of RFC 6749 section 5.2.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IssuedTokenType  string `json:"issued_token_type"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Scope            string `json:"scope"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange exchanges subject for a token restricted to the configured
+// audience and scopes. The result is cached until it expires, but
+// never beyond the expiry of subject.
+func (e *Exchanger) Exchange(ctx context.Context, subject *oauth2.Token) (*oauth2.Token, error) {
+	if subject == nil || subject.AccessToken == "" {
+		return nil, errors.New("no subject token")
+	}
+	key := cacheKey(subject.AccessToken)
+	if t := e.cached(key); t != nil {
+		return t, nil
+	}
+
+	form := url.Values{
+		"grant_type":           {GrantType},
+		"subject_token":        {subject.AccessToken},
+		"subject_token_type":   {AccessTokenType},
+		"requested_token_type": {e.c.RequestedTokenType},
+	}
+	if e.c.Audience != "" {
+		form.Set("audience", e.c.Audience)
+	}
+	if e.c.Resource != "" {
+		form.Set("resource", e.c.Resource)
+	}
+	if len(e.c.Scopes) > 0 {
+		form.Set("scope", strings.Join(e.c.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if e.c.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(e.c.ClientID), url.QueryEscape(e.c.ClientSecret))
+	}
+	ginoauth2.SetFlowIDHeader(ctx, req)
+
+	client := e.c.HTTPClient
+	if client == nil {
+		client = &http.Client{Transport: &ginoauth2.Transport}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, ginoauth2.RedactError(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, fmt.Errorf("token exchange failed with status %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("token exchange failed with status %d: %s %s", resp.StatusCode, tr.Error, ginoauth2.Redact(tr.ErrorDescription))
+	}
+	if tr.AccessToken == "" {
+		return nil, errors.New("token exchange response without access_token")
+	}
+
+	t := &oauth2.Token{AccessToken: tr.AccessToken, TokenType: tr.TokenType}
+	if strings.EqualFold(t.TokenType, "N_A") || t.TokenType == "" {
+		t.TokenType = "Bearer"
+	}
+	if tr.ExpiresIn > 0 {
+		t.Expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	if !subject.Expiry.IsZero() && (t.Expiry.IsZero() || subject.Expiry.Before(t.Expiry)) {
+		t.Expiry = subject.Expiry
+	}
+	t = t.WithExtra(map[string]interface{}{"issued_token_type": tr.IssuedTokenType, "scope": tr.Scope})
+
+	e.store(key, t)
+	ginoauth2.Log().Debugw("Exchanged token", "audience", e.c.Audience, "flow_id", ginoauth2.FlowIDFromContext(ctx))
+	return t, nil
+}
+
+type tokenSource struct {
+	ctx     context.Context
+	e       *Exchanger
+	subject *oauth2.Token
+}
+
+func (ts *tokenSource) Token() (*oauth2.Token, error) {
+	return ts.e.Exchange(ts.ctx, ts.subject)
+}
+
+// TokenSource returns an oauth2.TokenSource which provides the
+// exchanged token for the caller identified by tc. ctx is used for
+// exchange requests and should be the context of the incoming
+// request.
+func (e *Exchanger) TokenSource(ctx context.Context, tc *ginoauth2.TokenContainer) oauth2.TokenSource {
+	var subject *oauth2.Token
+	if tc != nil {
+		subject = tc.Token
+	}
+	return &tokenSource{ctx: ctx, e: e, subject: subject}
+}
@@ -0,0 +1,114 @@
+package tokenexchange
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ginoauth2 "github.com/zalando/gin-oauth2"
+	"github.com/zalando/gin-oauth2/tokenexchange/tokenexchangetest"
+	"golang.org/x/oauth2"
+)
+
+func caller(token string, expiry time.Time) *ginoauth2.TokenContainer {
+	return &ginoauth2.TokenContainer{Token: &oauth2.Token{AccessToken: token, TokenType: "Bearer", Expiry: expiry}}
+}
+
+func TestExchange(t *testing.T) {
+	srv := tokenexchangetest.NewServer()
+	defer srv.Close()
+
+	e := NewExchanger(Config{
+		TokenURL:     srv.URL,
+		ClientID:     "my-service",
+		ClientSecret: "secret",
+		Audience:     "orders",
+		Scopes:       []string{"orders.read", "orders.write"},
+	})
+
+	tok, err := e.TokenSource(context.Background(), caller("caller-token", time.Now().Add(time.Hour))).Token()
+	require.NoError(t, err)
+	assert.Equal(t, "exchanged-1", tok.AccessToken)
+	assert.Equal(t, "Bearer", tok.TokenType)
+	assert.Equal(t, "orders.read orders.write", tok.Extra("scope"))
+
+	exchanges := srv.Exchanges()
+	require.Len(t, exchanges, 1)
+	assert.Equal(t, tokenexchangetest.Exchange{
+		SubjectToken: "caller-token",
+		Audience:     "orders",
+		Scope:        "orders.read orders.write",
+		ClientID:     "my-service",
+	}, exchanges[0])
+}
+
+func TestExchangeIsCachedUntilExpiry(t *testing.T) {
+	srv := tokenexchangetest.NewServer()
+	defer srv.Close()
+	e := NewExchanger(Config{TokenURL: srv.URL, Audience: "orders"})
+	ctx := context.Background()
+
+	first, err := e.TokenSource(ctx, caller("a", time.Now().Add(time.Hour))).Token()
+	require.NoError(t, err)
+	again, err := e.TokenSource(ctx, caller("a", time.Now().Add(time.Hour))).Token()
+	require.NoError(t, err)
+	other, err := e.TokenSource(ctx, caller("b", time.Now().Add(time.Hour))).Token()
+	require.NoError(t, err)
+
+	assert.Equal(t, first.AccessToken, again.AccessToken)
+	assert.NotEqual(t, first.AccessToken, other.AccessToken)
+	assert.Len(t, srv.Exchanges(), 2)
+
+	// a token expiring within the expiry delta is exchanged again
+	srv.ExpiresIn = 5
+	short, err := e.TokenSource(ctx, caller("c", time.Now().Add(time.Hour))).Token()
+	require.NoError(t, err)
+	renewed, err := e.TokenSource(ctx, caller("c", time.Now().Add(time.Hour))).Token()
+	require.NoError(t, err)
+	assert.NotEqual(t, short.AccessToken, renewed.AccessToken)
+}
+
+func TestExchangedTokenDoesNotOutliveSubject(t *testing.T) {
+	srv := tokenexchangetest.NewServer()
+	defer srv.Close()
+	e := NewExchanger(Config{TokenURL: srv.URL})
+
+	expiry := time.Now().Add(time.Minute)
+	tok, err := e.TokenSource(context.Background(), caller("a", expiry)).Token()
+	require.NoError(t, err)
+	assert.True(t, tok.Expiry.Equal(expiry))
+}
+
+func TestExchangeRejected(t *testing.T) {
+	srv := tokenexchangetest.NewServer()
+	defer srv.Close()
+	srv.Accept = func(string) bool { return false }
+	e := NewExchanger(Config{TokenURL: srv.URL})
+
+	_, err := e.TokenSource(context.Background(), caller("a", time.Now().Add(time.Hour))).Token()
+	assert.ErrorContains(t, err, "invalid_grant")
+
+	_, err = e.TokenSource(context.Background(), nil).Token()
+	assert.Error(t, err)
+}
+
+func TestExchangeUsedByClient(t *testing.T) {
+	srv := tokenexchangetest.NewServer()
+	defer srv.Close()
+	var auth string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer downstream.Close()
+
+	e := NewExchanger(Config{TokenURL: srv.URL, Audience: "orders"})
+	client := oauth2.NewClient(context.Background(), e.TokenSource(context.Background(), caller("a", time.Now().Add(time.Hour))))
+	resp, err := client.Get(downstream.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "Bearer exchanged-1", auth)
+}
@@ -0,0 +1,103 @@
+// Package tokenexchangetest provides a fake RFC 8693 token exchange
+// endpoint for tests.
+package tokenexchangetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+)
+
+// Exchange records a token exchange request received by the Server.
+type Exchange struct {
+	SubjectToken string
+	Audience     string
+	Resource     string
+	Scope        string
+	ClientID     string
+}
+
+// Server is a fake token exchange endpoint. It issues tokens of the
+// form "exchanged-<n>" for every subject token accepted by Accept.
+type Server struct {
+	*httptest.Server
+
+	// Accept decides if a subject token is exchanged, defaults to
+	// accepting all tokens.
+	Accept func(subjectToken string) bool
+	// ExpiresIn is the lifetime of issued tokens in seconds, defaults
+	// to 3600.
+	ExpiresIn int64
+
+	count atomic.Int64
+	mu    sync.Mutex
+	reqs  []Exchange
+}
+
+// NewServer starts a fake token exchange endpoint. The exchange URL is
+// Server.URL. Call Close when done.
+func NewServer() *Server {
+	s := &Server{ExpiresIn: 3600}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Exchanges returns all exchange requests received so far.
+func (s *Server) Exchanges() []Exchange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Exchange(nil), s.reqs...)
+}
+
+func writeError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request", "POST required")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:token-exchange" {
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	subject := r.PostForm.Get("subject_token")
+	if subject == "" || r.PostForm.Get("subject_token_type") == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "subject_token and subject_token_type are required")
+		return
+	}
+	if s.Accept != nil && !s.Accept(subject) {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "subject token not accepted")
+		return
+	}
+
+	clientID, _, _ := r.BasicAuth()
+	s.mu.Lock()
+	s.reqs = append(s.reqs, Exchange{
+		SubjectToken: subject,
+		Audience:     r.PostForm.Get("audience"),
+		Resource:     r.PostForm.Get("resource"),
+		Scope:        r.PostForm.Get("scope"),
+		ClientID:     clientID,
+	})
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":      fmt.Sprintf("exchanged-%d", s.count.Add(1)),
+		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+		"token_type":        "Bearer",
+		"expires_in":        s.ExpiresIn,
+		"scope":             r.PostForm.Get("scope"),
+	})
+}
@@ -0,0 +1,95 @@
+package zalando
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	ginoauth2 "github.com/zalando/gin-oauth2"
+)
+
+// LegacyContextKeys additionally sets the identity as the string keys
+// "uid", "team", "cn" and the names of the granted scopes in the
+// gin.Context, as before Identity was introduced. These keys can
+// collide with keys of the application. It is enabled during a
+// deprecation period, migrate to IdentityFromContext and set it to
+// false; the default will change in a future release.
+var LegacyContextKeys = true
+
+// Identity is set by the checks of this package for authorized
+// requests, see IdentityFromContext.
+type Identity struct {
+	UID   string
+	Realm string
+	// Team is the official team of the user, set by GroupCheck and
+	// NoAuthorization.
+	Team string
+	// Cn is the real name of the AccessTuple which granted access,
+	// set by UidCheck.
+	Cn string
+	// Scopes are the values of the scopes granted by ScopeCheck and
+	// ScopeAndCheck.
+	Scopes map[string]interface{}
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the Identity set by the checks of this
+// package. ctx may be the *gin.Context or the context of its request.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	if gc, ok := ctx.(*gin.Context); ok {
+		if v, ok := gc.Get(identityKey{}); ok {
+			id, ok := v.(Identity)
+			return id, ok
+		}
+		if gc.Request == nil {
+			return Identity{}, false
+		}
+		ctx = gc.Request.Context()
+	}
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// UID returns the uid of the authorized user or service, or "".
+func UID(ctx context.Context) string {
+	id, _ := IdentityFromContext(ctx)
+	return id.UID
+}
+
+// Team returns the official team of the authorized user, or "".
+func Team(ctx context.Context) string {
+	id, _ := IdentityFromContext(ctx)
+	return id.Team
+}
+
+// Cn returns the real name of the authorized user, or "".
+func Cn(ctx context.Context) string {
+	id, _ := IdentityFromContext(ctx)
+	return id.Cn
+}
+
+// updateIdentity applies update to the Identity of ctx and stores the
+// result in ctx and, once access is granted, the context of its
+// request.
+func updateIdentity(ctx *gin.Context, update func(*Identity)) {
+	id, _ := IdentityFromContext(ctx)
+	scopes := make(map[string]interface{}, len(id.Scopes))
+	for k, v := range id.Scopes {
+		scopes[k] = v
+	}
+	id.Scopes = scopes
+	update(&id)
+
+	ginoauth2.SetRequestValue(ctx, identityKey{}, id)
+	if !LegacyContextKeys {
+		return
+	}
+	for k, v := range id.Scopes {
+		ctx.Set(k, v)
+	}
+	for k, v := range map[string]string{"uid": id.UID, "team": id.Team, "cn": id.Cn} {
+		if v != "" {
+			ctx.Set(k, v)
+		}
+	}
+}
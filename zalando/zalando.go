@@ -3,14 +3,14 @@
 package zalando
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"net/http"
 	"net/url"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
 	ginoauth2 "github.com/zalando/gin-oauth2"
 	"golang.org/x/oauth2"
 )
@@ -48,18 +48,40 @@ var OAuth2Endpoint = oauth2.Endpoint{
 // TeamAPI is a custom API
 var TeamAPI string = "https://teams.auth.zalando.com/api/teams"
 
+// TeamAPITokenSource authenticates requests to the TeamAPI. If it is
+// nil, Options.ServiceTokenSource of the middleware is used and, if
+// that is not set either, the token of the caller, which must then
+// carry the scopes required by the TeamAPI.
+var TeamAPITokenSource oauth2.TokenSource
+
 // RequestTeamInfo is a function that returns team information for a
 // given token.
 func RequestTeamInfo(tc *ginoauth2.TokenContainer, uri string) ([]byte, error) {
+	return RequestTeamInfoContext(context.Background(), tc, uri)
+}
+
+// RequestTeamInfoContext is like RequestTeamInfo, but forwards the
+// flow ID found in ctx to the Teams API and authenticates with the
+// service token source found in ctx, see TeamAPITokenSource.
+func RequestTeamInfoContext(ctx context.Context, tc *ginoauth2.TokenContainer, uri string) ([]byte, error) {
+	uid := scopeUID(tc)
+	if uid == "" {
+		return nil, errors.New("token has no uid")
+	}
 	var uv = make(url.Values)
-	uv.Set("member", tc.Scopes["uid"].(string))
+	uv.Set("member", uid)
 	infoURL := uri + "?" + uv.Encode()
 	client := &http.Client{Transport: &ginoauth2.Transport}
-	req, err := http.NewRequest("GET", infoURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", infoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	ginoauth2.SetFlowIDHeader(ctx, req)
+	auth, err := teamAPIToken(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tc.Token.AccessToken))
+	auth.SetAuthHeader(req)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -70,57 +92,96 @@ func RequestTeamInfo(tc *ginoauth2.TokenContainer, uri string) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
+// scopeUID returns the uid granted by the "uid" scope. Unlike
+// TokenContainer.UID it does not fall back to the raw claims, such that
+// the checks of this package only authorize tokens with the uid scope.
+func scopeUID(tc *ginoauth2.TokenContainer) string {
+	uid, _ := tc.Scopes["uid"].(string)
+	return uid
+}
+
+// requestContext returns the context of the request of ctx or ctx
+// itself, if it has no request, p.e. in tests.
+func requestContext(ctx *gin.Context) context.Context {
+	if ctx.Request != nil {
+		return ctx.Request.Context()
+	}
+	return ctx
+}
+
+// teamAPIToken returns the token to authenticate a TeamAPI request.
+func teamAPIToken(ctx context.Context, tc *ginoauth2.TokenContainer) (*oauth2.Token, error) {
+	ts := TeamAPITokenSource
+	if ts == nil {
+		ts, _ = ginoauth2.ServiceTokenSourceFromContext(ctx)
+	}
+	if ts == nil {
+		return tc.Token, nil
+	}
+	return ts.Token()
+}
+
 // GroupCheck is an authorization function that checks, if the Token
 // was issued for an employee of a specified team. The given
-// TokenContainer must be valid. As side effect it sets "uid" and
-// "team" in the gin.Context to the "official" team.
+// TokenContainer must be valid. As side effect it sets the UID and
+// the "official" Team of the Identity, also if access is denied.
 func GroupCheck(at []AccessTuple) func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool {
 	ats := at
 	return func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool {
-		blob, err := RequestTeamInfo(tc, TeamAPI)
+		blob, err := RequestTeamInfoContext(requestContext(ctx), tc, TeamAPI)
 		if err != nil {
-			glog.Errorf("[Gin-OAuth] failed to get team info, caused by: %s", err)
+			ginoauth2.Log().Errorw("failed to get team info", "flow_id", ginoauth2.FlowIDFromContext(ctx), "error", err)
 			return false
 		}
 		var data []TeamInfo
 		err = json.Unmarshal(blob, &data)
 		if err != nil {
-			glog.Errorf("[Gin-OAuth] JSON.Unmarshal failed, caused by: %s", err)
+			ginoauth2.Log().Errorw("JSON.Unmarshal of team info failed", "flow_id", ginoauth2.FlowIDFromContext(ctx), "error", err)
 			return false
 		}
 		granted := false
+		official := ""
 		for _, teamInfo := range data {
 			for idx := range ats {
 				at := ats[idx]
 				if teamInfo.Id == at.Uid {
 					granted = true
-					glog.Infof("[Gin-OAuth] Grant access to %s as team member of \"%s\"\n", tc.Scopes["uid"].(string), teamInfo.Id)
-				}
-				if teamInfo.Type == "official" {
-					ctx.Set("uid", tc.Scopes["uid"].(string))
-					ctx.Set("team", teamInfo.Id)
+					ginoauth2.Log().Infow("Grant access as team member", "flow_id", ginoauth2.FlowIDFromContext(ctx), "uid", scopeUID(tc), "team", teamInfo.Id)
 				}
 			}
+			if teamInfo.Type == "official" {
+				official = teamInfo.Id
+			}
+		}
+		// the official team is set whether access is granted or not
+		if granted || official != "" {
+			updateIdentity(ctx, func(id *Identity) {
+				id.UID, id.Realm = scopeUID(tc), tc.Realm
+				if official != "" {
+					id.Team = official
+				}
+			})
 		}
 		return granted
 	}
 }
 
 // UidCheck is an authorization function that checks UID scope
-// TokenContainer must be Valid. As side effect it sets "uid" and
-// "cn" in the gin.Context to the authorized uid and cn (Realname).
+// TokenContainer must be Valid. As side effect it sets the UID and Cn
+// (Realname) of the Identity to the authorized uid and cn.
 //
 //lint:ignore ST1003 public interface
 func UidCheck(at []AccessTuple) func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool {
 	ats := at
 	return func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool {
-		uid := tc.Scopes["uid"].(string)
+		uid := scopeUID(tc)
 		for idx := range ats {
 			at := ats[idx]
 			if tc.Realm == at.Realm && uid == at.Uid {
-				ctx.Set("uid", uid)  //in this way I can set the authorized uid
-				ctx.Set("cn", at.Cn) //in this way I can set the authorized Realname
-				glog.Infof("[Gin-OAuth] Grant access to %s\n", uid)
+				updateIdentity(ctx, func(id *Identity) {
+					id.UID, id.Realm, id.Cn = uid, tc.Realm, at.Cn
+				})
+				ginoauth2.Log().Infow("Grant access", "flow_id", ginoauth2.FlowIDFromContext(ctx), "uid", uid, "realm", tc.Realm)
 				return true
 			}
 		}
@@ -130,55 +191,67 @@ func UidCheck(at []AccessTuple) func(tc *ginoauth2.TokenContainer, ctx *gin.Cont
 
 // ScopeCheck does an OR check of scopes given from token of the
 // request to all provided scopes. If one of provided scopes is in the
-// Scopes of the token it grants access to the resource.
+// Scopes of the token it grants access to the resource. As side effect
+// it sets the UID and the values of the granted scopes of the Identity.
 func ScopeCheck(name string, scopes ...string) func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool {
-	glog.Infof("ScopeCheck %s configured to grant access for scopes: %v", name, scopes)
+	ginoauth2.Log().Infow("ScopeCheck configured to grant access for any scope", "name", name, "scopes", scopes)
 	configuredScopes := scopes
 	return func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool {
-		scopesFromToken := make([]string, 0)
+		scopesFromToken := make(map[string]interface{})
 		for _, s := range configuredScopes {
 			if cur, ok := tc.Scopes[s]; ok {
-				glog.V(2).Infof("Found configured scope %s", s)
-				scopesFromToken = append(scopesFromToken, s)
-				ctx.Set(s, cur) // set value from token of configured scope to the context, which you can use in your application.
+				ginoauth2.Log().Debugw("Found configured scope", "scope", s)
+				scopesFromToken[s] = cur
 			}
 		}
-		//Getting the uid for identification of the service calling
-		if cur, ok := tc.Scopes["uid"]; ok {
-			ctx.Set("uid", cur)
+		if len(scopesFromToken) == 0 {
+			return false
 		}
-		return len(scopesFromToken) > 0
+		setScopes(ctx, tc, scopesFromToken)
+		return true
 	}
 }
 
 // ScopeAndCheck does an AND check of scopes given from token of the
 // request to all provided scopes. Only if all of provided scopes are found in the
-// Scopes of the token it grants access to the resource.
+// Scopes of the token it grants access to the resource. As side effect
+// it sets the UID and the values of the scopes of the Identity.
 func ScopeAndCheck(name string, scopes ...string) func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool {
-	glog.Infof("ScopeCheck %s configured to grant access only if scopes: %v are present", name, scopes)
+	ginoauth2.Log().Infow("ScopeCheck configured to grant access only if all scopes are present", "name", name, "scopes", scopes)
 	configuredScopes := scopes
 	return func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool {
+		scopesFromToken := make(map[string]interface{})
 		for _, s := range configuredScopes {
 			if cur, ok := tc.Scopes[s]; ok {
-				glog.V(2).Infof("Found configured scope %s", s)
-				ctx.Set(s, cur) // set value from token of configured scope to the context, which you can use in your application.
+				ginoauth2.Log().Debugw("Found configured scope", "scope", s)
+				scopesFromToken[s] = cur
 			} else {
 				return false
 			}
 		}
-		//Getting the uid for identification of the service calling
-		if cur, ok := tc.Scopes["uid"]; ok {
-			ctx.Set("uid", cur)
-		}
+		setScopes(ctx, tc, scopesFromToken)
 		return true
 	}
 }
 
-// NoAuthorization sets "team" and "uid" in the context without
+// setScopes adds the values of the granted scopes and the uid of the
+// calling service to the Identity.
+func setScopes(ctx *gin.Context, tc *ginoauth2.TokenContainer, scopes map[string]interface{}) {
+	updateIdentity(ctx, func(id *Identity) {
+		for s, v := range scopes {
+			id.Scopes[s] = v
+		}
+		if uid := scopeUID(tc); uid != "" {
+			id.UID, id.Realm = uid, tc.Realm
+		}
+	})
+}
+
+// NoAuthorization sets the UID and Team of the Identity without
 // checking if the user/team is authorized.
 func NoAuthorization() func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool {
 	return func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool {
-		blob, err := RequestTeamInfo(tc, TeamAPI)
+		blob, err := RequestTeamInfoContext(requestContext(ctx), tc, TeamAPI)
 		if err != nil {
 			return false
 		}
@@ -186,13 +259,14 @@ func NoAuthorization() func(tc *ginoauth2.TokenContainer, ctx *gin.Context) bool
 		var data []TeamInfo
 		err = json.Unmarshal(blob, &data)
 		if err != nil {
-			glog.Errorf("[Gin-OAuth] JSON.Unmarshal failed, caused by: %s", err)
+			ginoauth2.Log().Errorw("JSON.Unmarshal of team info failed", "flow_id", ginoauth2.FlowIDFromContext(ctx), "error", err)
 			return false
 		}
 		for _, teamInfo := range data {
 			if teamInfo.Type == "official" {
-				ctx.Set("uid", tc.Scopes["uid"].(string))
-				ctx.Set("team", teamInfo.Id)
+				updateIdentity(ctx, func(id *Identity) {
+					id.UID, id.Realm, id.Team = scopeUID(tc), tc.Realm, teamInfo.Id
+				})
 				return true
 			}
 		}
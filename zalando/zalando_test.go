@@ -3,10 +3,9 @@ package zalando
 import (
 	"encoding/json"
 	"fmt"
-	"io"
+	"net/http"
 	"net/http/httptest"
 	"os"
-	"strings"
 	"testing"
 	"time"
 
@@ -23,17 +22,11 @@ import (
 var tokenFile string = fmt.Sprintf("%s/.chimp-token", os.Getenv("HOME"))
 
 func getToken() (string, error) {
-	file, err := os.Open(tokenFile)
+	tok, err := ginoauth2.NewFileTokenSource(tokenFile, 0).Token()
 	if err != nil {
-		return "not a file", err
+		return "not a valid token file", err
 	}
-	defer file.Close()
-
-	data, err := io.ReadAll(file)
-	if err != nil {
-		return "reading failed", err
-	}
-	return strings.TrimSpace(string(data)), nil
+	return tok.AccessToken, nil
 }
 
 func TestRequestTeamInfo(t *testing.T) {
@@ -99,6 +92,11 @@ func TestScopeCheck(t *testing.T) {
 	uid, uidOk := ctx.Get("uid")
 	assert.True(t, uidOk)
 	assert.Equal(t, "stups_marilyn-updater", uid)
+
+	id, ok := IdentityFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"my-scope-1": true}, id.Scopes)
+	assert.Equal(t, "stups_marilyn-updater", UID(ctx))
 }
 
 func TestScopeAndCheck(t *testing.T) {
@@ -132,4 +130,250 @@ func TestScopeAndCheck(t *testing.T) {
 	assert.Equal(t, "stups_marilyn-updater", uidVal)
 	assert.True(t, scopeOk)
 	assert.Equal(t, true, scopeVal)
+
+	id, ok := IdentityFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "stups_marilyn-updater", id.UID)
+	assert.Equal(t, "/services", id.Realm)
+	assert.Equal(t, true, id.Scopes["my-scope-2"])
+}
+
+func TestGroupCheckForwardsFlowID(t *testing.T) {
+	// given
+	var flowID string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flowID = r.Header.Get(ginoauth2.FlowIDHeader)
+		assert.Equal(t, "sszuecs", r.URL.Query().Get("member"))
+		json.NewEncoder(w).Encode([]TeamInfo{{Id: "teapot", Type: "official"}})
+	}))
+	defer srv.Close()
+	defer func(api string) { TeamAPI = api }(TeamAPI)
+	TeamAPI = srv.URL
+
+	tc := &ginoauth2.TokenContainer{
+		Token:  &oauth2.Token{AccessToken: "token", TokenType: "Bearer"},
+		Scopes: map[string]interface{}{"uid": "sszuecs"},
+		Realm:  "/employees",
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx.Request = ctx.Request.WithContext(ginoauth2.WithFlowID(ctx.Request.Context(), "JAh6xdAxMQiOXQp1"))
+
+	// when
+	result := GroupCheck([]AccessTuple{{Realm: "teams", Uid: "teapot"}})(tc, ctx)
+
+	// then
+	assert.True(t, result)
+	assert.Equal(t, "JAh6xdAxMQiOXQp1", flowID)
+	team, _ := ctx.Get("team")
+	assert.Equal(t, "teapot", team)
+	assert.Equal(t, "teapot", Team(ctx))
+	assert.Equal(t, "sszuecs", UID(ctx))
+}
+
+func TestGroupCheckWithoutRequest(t *testing.T) {
+	// given
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]TeamInfo{{Id: "teapot", Type: "official"}})
+	}))
+	defer srv.Close()
+	defer func(api string) { TeamAPI = api }(TeamAPI)
+	TeamAPI = srv.URL
+
+	tc := &ginoauth2.TokenContainer{
+		Token:  &oauth2.Token{AccessToken: "token", TokenType: "Bearer"},
+		Scopes: map[string]interface{}{"uid": "sszuecs"},
+		Realm:  "/employees",
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	// when, then
+	assert.NotPanics(t, func() {
+		assert.False(t, GroupCheck([]AccessTuple{{Realm: "teams", Uid: "coffeepot"}})(tc, ctx))
+	})
+	// the official team is set, although access was denied
+	assert.Equal(t, "teapot", Team(ctx))
+	assert.Equal(t, "sszuecs", UID(ctx))
+	team, _ := ctx.Get("team")
+	assert.Equal(t, "teapot", team)
+
+	ctx, _ = gin.CreateTestContext(httptest.NewRecorder())
+	assert.NotPanics(t, func() {
+		assert.True(t, NoAuthorization()(tc, ctx))
+	})
+	assert.Equal(t, "teapot", Team(ctx))
+}
+
+func TestGroupCheckUsesServiceToken(t *testing.T) {
+	// given
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode([]TeamInfo{{Id: "teapot", Type: "official"}})
+	}))
+	defer srv.Close()
+	defer func(api string) { TeamAPI = api }(TeamAPI)
+	TeamAPI = srv.URL
+
+	tc := &ginoauth2.TokenContainer{
+		Token:  &oauth2.Token{AccessToken: "caller", TokenType: "Bearer"},
+		Scopes: map[string]interface{}{"uid": "sszuecs"},
+	}
+	service := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "service"})
+	check := GroupCheck([]AccessTuple{{Uid: "teapot"}})
+
+	// when
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.True(t, check(tc, ctx))
+
+	ctx.Request = ctx.Request.WithContext(ginoauth2.WithServiceTokenSource(ctx.Request.Context(), service))
+	assert.True(t, check(tc, ctx))
+
+	TeamAPITokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "global"})
+	defer func() { TeamAPITokenSource = nil }()
+	assert.True(t, check(tc, ctx))
+
+	// then
+	assert.Equal(t, []string{"Bearer caller", "Bearer service", "Bearer global"}, auth)
+}
+
+func TestGroupCheckWithoutUID(t *testing.T) {
+	// given
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+	defer func(api string) { TeamAPI = api }(TeamAPI)
+	TeamAPI = srv.URL
+
+	tc := &ginoauth2.TokenContainer{
+		Token:  &oauth2.Token{AccessToken: "token", TokenType: "Bearer"},
+		Scopes: map[string]interface{}{"uid": 42},
+		Realm:  "/services",
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// when, then
+	assert.NotPanics(t, func() {
+		assert.False(t, GroupCheck([]AccessTuple{{Uid: "teapot"}})(tc, ctx))
+		assert.False(t, UidCheck([]AccessTuple{{Realm: "/services", Uid: "stups_teapot"}})(tc, ctx))
+		assert.False(t, NoAuthorization()(tc, ctx))
+	})
+	assert.False(t, called)
+}
+
+func TestChecksRequireUIDScope(t *testing.T) {
+	// given
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+	defer func(api string) { TeamAPI = api }(TeamAPI)
+	TeamAPI = srv.URL
+
+	// the uid is a claim of the tokeninfo response, but not a scope
+	tc := &ginoauth2.TokenContainer{
+		Token:     &oauth2.Token{AccessToken: "token", TokenType: "Bearer"},
+		Scopes:    map[string]interface{}{},
+		RawClaims: map[string]interface{}{"uid": "sszuecs"},
+		Realm:     "/employees",
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// when, then
+	assert.Equal(t, "sszuecs", tc.UID())
+	assert.False(t, UidCheck([]AccessTuple{{Realm: "/employees", Uid: "sszuecs"}})(tc, ctx))
+	assert.False(t, GroupCheck([]AccessTuple{{Uid: "teapot"}})(tc, ctx))
+	assert.False(t, called)
+}
+
+func TestIdentityInRequestContext(t *testing.T) {
+	// given
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token",
+			"token_type":   "Bearer",
+			"expires_in":   float64(3600),
+			"realm":        "/employees",
+			"scope":        []interface{}{"uid"},
+			"uid":          "sszuecs",
+		})
+	}))
+	defer srv.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ginoauth2.AuthChainOptions(ginoauth2.Options{Endpoint: oauth2.Endpoint{TokenURL: srv.URL}},
+		UidCheck([]AccessTuple{{Realm: "/employees", Uid: "sszuecs", Cn: "Sandor Szücs"}})))
+	var fromGin, fromRequest Identity
+	router.GET("/", func(c *gin.Context) {
+		fromGin, _ = IdentityFromContext(c)
+		fromRequest, _ = IdentityFromContext(c.Request.Context())
+		c.Status(http.StatusOK)
+	})
+
+	// when
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// then
+	assert.Equal(t, http.StatusOK, w.Code)
+	want := Identity{UID: "sszuecs", Realm: "/employees", Cn: "Sandor Szücs", Scopes: map[string]interface{}{}}
+	assert.Equal(t, want, fromGin)
+	assert.Equal(t, want, fromRequest)
+}
+
+func TestLegacyContextKeys(t *testing.T) {
+	// given
+	tc := &ginoauth2.TokenContainer{
+		Token:  &oauth2.Token{AccessToken: "token", TokenType: "Bearer"},
+		Scopes: map[string]interface{}{"uid": "sszuecs", "my-scope-1": true},
+		Realm:  "/employees",
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	// when
+	assert.True(t, ScopeCheck("name", "my-scope-1")(tc, ctx))
+	assert.True(t, UidCheck([]AccessTuple{{Realm: "/employees", Uid: "sszuecs", Cn: "Sandor Szücs"}})(tc, ctx))
+
+	// then
+	for k, want := range map[string]interface{}{"uid": "sszuecs", "cn": "Sandor Szücs", "my-scope-1": true} {
+		v, ok := ctx.Get(k)
+		assert.True(t, ok, k)
+		assert.Equal(t, want, v, k)
+	}
+	_, ok := ctx.Get("team")
+	assert.False(t, ok)
+	assert.Equal(t, true, ctx.MustGet("my-scope-1"))
+	id, _ := IdentityFromContext(ctx)
+	assert.Equal(t, Identity{UID: "sszuecs", Realm: "/employees", Cn: "Sandor Szücs", Scopes: map[string]interface{}{"my-scope-1": true}}, id)
+}
+
+func TestLegacyContextKeysDisabled(t *testing.T) {
+	// given
+	defer func() { LegacyContextKeys = true }()
+	LegacyContextKeys = false
+	tc := &ginoauth2.TokenContainer{
+		Token:  &oauth2.Token{AccessToken: "token", TokenType: "Bearer"},
+		Scopes: map[string]interface{}{"uid": "sszuecs", "my-scope-1": true},
+		Realm:  "/employees",
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	// when
+	assert.True(t, ScopeCheck("name", "my-scope-1")(tc, ctx))
+
+	// then
+	for _, k := range []string{"uid", "my-scope-1"} {
+		_, ok := ctx.Get(k)
+		assert.False(t, ok, k)
+	}
+	assert.Equal(t, "sszuecs", UID(ctx))
 }